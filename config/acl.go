@@ -0,0 +1,72 @@
+package config
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ACLIMPLICITDENY the rule of a client matching no allow rule
+const ACLIMPLICITDENY = "implicit deny"
+
+// ACLConfig the clients allowed to connect to a group. A client matching a deny rule is denied,
+// otherwise it must match an allow rule unless allow is empty
+type ACLConfig struct {
+	Allow []string `json:"allow" mapstructure:"allow" yaml:"allow"` // CIDR ranges or single ips
+	Deny  []string `json:"deny" mapstructure:"deny" yaml:"deny"`    // CIDR ranges or single ips, checked before allow
+}
+
+// Enabled whether any rule is configured
+func (c ACLConfig) Enabled() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0
+}
+
+// Validate checks every rule is a CIDR range or an ip
+func (c ACLConfig) Validate() error {
+	for _, rule := range append(append([]string(nil), c.Deny...), c.Allow...) {
+		if _, err := parseACLRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check returns whether the client ip is allowed and the rule deciding it, a nil ip only matches the implicit deny
+func (c ACLConfig) Check(ip net.IP) (bool, string) {
+	for _, rule := range c.Deny {
+		if network, err := parseACLRule(rule); err == nil && ip != nil && network.Contains(ip) {
+			return false, "deny " + rule
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true, ""
+	}
+
+	for _, rule := range c.Allow {
+		if network, err := parseACLRule(rule); err == nil && ip != nil && network.Contains(ip) {
+			return true, "allow " + rule
+		}
+	}
+	return false, ACLIMPLICITDENY
+}
+
+// parseACLRule returns the network of a CIDR range, a single ip is a /32 or /128 network
+func parseACLRule(rule string) (*net.IPNet, error) {
+	if strings.Contains(rule, "/") {
+		_, network, err := net.ParseCIDR(rule)
+		if err != nil {
+			return nil, errors.Errorf("invalid CIDR %q", rule)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(rule)
+	if ip == nil {
+		return nil, errors.Errorf("invalid ip %q", rule)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UNIXPREFIX marks the listen and the remote addresses of the unix domain sockets, like unix:/run/app.sock
+const UNIXPREFIX = "unix:"
+
+// The bind hosts which are not an ip address
+const (
+	BINDLOCALHOST = "localhost"
+	BINDANY       = "*" // every ipv4 and ipv6 address of the host
+)
+
+// ListenAddress returns the address the group listens on, a unix domain socket is returned as it is
+func (group GroupConfig) ListenAddress() string {
+	if IsUnix(group.Listen) {
+		return group.Listen
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(group.Bind, "["), "]")
+	if host == BINDANY {
+		host = ""
+	}
+	return net.JoinHostPort(host, group.Listen)
+}
+
+// validateBind checks the bind host is localhost, * or an ip address, an ipv6 address may have brackets and a zone
+func (group GroupConfig) validateBind() error {
+	host := strings.TrimSuffix(strings.TrimPrefix(group.Bind, "["), "]")
+	switch host {
+	case BINDLOCALHOST, BINDANY:
+		return nil
+	}
+
+	if i := strings.LastIndex(host, "%"); i > 0 && strings.Contains(host, ":") {
+		host = host[:i]
+	}
+	if net.ParseIP(host) == nil {
+		return errors.Errorf("bind must be localhost, * or an ip address, got %q", group.Bind)
+	}
+	return nil
+}
+
+// IsUnix reports whether the address is a unix domain socket
+func IsUnix(address string) bool {
+	return strings.HasPrefix(address, UNIXPREFIX)
+}
+
+// SplitNetwork returns the network and the address to dial or to listen on, a unix domain socket
+// is dialed as unix whatever the network of the group
+func SplitNetwork(network, address string) (string, string) {
+	if IsUnix(address) {
+		return "unix", strings.TrimPrefix(address, UNIXPREFIX)
+	}
+	return network, address
+}
+
+// validateUnix checks the unix domain socket addresses of the group, the udp groups use none
+func (group GroupConfig) validateUnix() error {
+	addresses := append([]string{group.Listen}, group.Servers...)
+	for _, pool := range group.Pools {
+		addresses = append(addresses, pool.Servers...)
+	}
+
+	for _, address := range addresses {
+		if !IsUnix(address) {
+			continue
+		}
+		if strings.TrimPrefix(address, UNIXPREFIX) == "" {
+			return errors.Errorf("%s has no path", address)
+		}
+		if group.Type == GROUPUDP {
+			return errors.Errorf("udp type has no unix domain socket %s", address)
+		}
+	}
+	return nil
+}
@@ -9,8 +9,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+	"github.com/wangff15386/goproxy/services/lb"
 )
 
 // ProxyConfig to start proxy service
@@ -24,12 +26,103 @@ type ProxyConfig struct {
 	HeartbeatKeepAlive time.Duration `json:"heartbeatkeepalive" mapstructure:"heartbeatkeepalive" yaml:"heartbeatkeepalive"`
 	AliveCheckInterval time.Duration `json:"alivecheckinterval" mapstructure:"alivecheckinterval" yaml:"alivecheckinterval"`
 	HandleBuffer       int           `json:"handlebuffer" mapstructure:"handlebuffer" yaml:"handlebuffer"`
+	DefaultWeight      int           `json:"defaultweight" mapstructure:"defaultweight" yaml:"defaultweight"`
+	DrainTimeout       time.Duration `json:"draintimeout" mapstructure:"draintimeout" yaml:"draintimeout"`
+	AccessLog          string        `json:"accesslog" mapstructure:"accesslog" yaml:"accesslog"` // file the access log is appended to, empty for stdout
+	Bind               string        `json:"bind" mapstructure:"bind" yaml:"bind"`                // host the groups listen on, defaults to localhost
+	Groups             []GroupConfig `json:"groups" mapstructure:"groups" yaml:"groups"`
+	StateFile          string        `json:"statefile" mapstructure:"statefile" yaml:"statefile"`
 }
 
+// GroupConfig to start a group, the zero values inherit from the global settings of ProxyConfig
+type GroupConfig struct {
+	Name          string        `json:"name" mapstructure:"name" yaml:"name"`       // group name used by the http api, defaults to Listen
+	Listen        string        `json:"listen" mapstructure:"listen" yaml:"listen"` // 监听端口, or unix:/path of a unix domain socket
+	Type          string        `json:"type" mapstructure:"type" yaml:"type"`       // tcp or udp, defaults to tcp
+	Bind          string        `json:"bind" mapstructure:"bind" yaml:"bind"`       // an ipv4 or ipv6 address, localhost or * for all of them
+	LBPolicy      int           `json:"lbpolicy" mapstructure:"lbpolicy" yaml:"lbpolicy"`
+	RWTimeout     time.Duration `json:"rwtimeout" mapstructure:"rwtimeout" yaml:"rwtimeout"`
+	HandleBuffer  int           `json:"handlebuffer" mapstructure:"handlebuffer" yaml:"handlebuffer"`
+	DefaultWeight int           `json:"defaultweight" mapstructure:"defaultweight" yaml:"defaultweight"` // weight of a worker which gives none
+	Servers       []string      `json:"servers" mapstructure:"servers" yaml:"servers"`                   // static remote addresses, they never expire
+	HashKey       string        `json:"hashkey" mapstructure:"hashkey" yaml:"hashkey"`                   // key of the hashing lb policies
+	HashPrefix    int           `json:"hashprefix" mapstructure:"hashprefix" yaml:"hashprefix"`          // IPv4 prefix length of the prefix hash key
+	HashPrefix6   int           `json:"hashprefix6" mapstructure:"hashprefix6" yaml:"hashprefix6"`       // IPv6 prefix length of the prefix hash key
+	Retries       int           `json:"retries" mapstructure:"retries" yaml:"retries"`                   // other remote addresses to dial after a failed dial, negative for none
+	DrainTimeout  time.Duration `json:"draintimeout" mapstructure:"draintimeout" yaml:"draintimeout"`    // how long the closing waits for the sessions, negative for none
+	AcceptProxy   string        `json:"acceptproxy" mapstructure:"acceptproxy" yaml:"acceptproxy"`       // PROXY header required on the client connections: v1, v2 or any
+	SendProxy     string        `json:"sendproxy" mapstructure:"sendproxy" yaml:"sendproxy"`             // PROXY header written on the backend connections: v1 or v2
+
+	HealthCheck      HealthCheckConfig      `json:"healthcheck" mapstructure:"healthcheck" yaml:"healthcheck"`
+	OutlierDetection OutlierDetectionConfig `json:"outlierdetection" mapstructure:"outlierdetection" yaml:"outlierdetection"`
+	TLS              TLSConfig              `json:"tls" mapstructure:"tls" yaml:"tls"`
+	BackendTLS       BackendTLSConfig       `json:"backendtls" mapstructure:"backendtls" yaml:"backendtls"`
+	Pools            []PoolConfig           `json:"pools" mapstructure:"pools" yaml:"pools"`    // named pools the routes send the sessions to
+	Routes           []RouteConfig          `json:"routes" mapstructure:"routes" yaml:"routes"` // checked in order against the TLS ClientHello
+	Limits           LimitsConfig           `json:"limits" mapstructure:"limits" yaml:"limits"`
+	ACL              ACLConfig              `json:"acl" mapstructure:"acl" yaml:"acl"` // replaced by acl-set.do until the next reload, see State
+}
+
+// HealthCheckConfig active probes of the remote addresses of a group, an empty type disables them
+type HealthCheckConfig struct {
+	Type     string        `json:"type" mapstructure:"type" yaml:"type"` // tcp, send or http
+	Interval time.Duration `json:"interval" mapstructure:"interval" yaml:"interval"`
+	Timeout  time.Duration `json:"timeout" mapstructure:"timeout" yaml:"timeout"`
+	Rise     int           `json:"rise" mapstructure:"rise" yaml:"rise"`       // consecutive successes to re-enter the selectable set
+	Fall     int           `json:"fall" mapstructure:"fall" yaml:"fall"`       // consecutive failures to leave the selectable set
+	Send     string        `json:"send" mapstructure:"send" yaml:"send"`       // bytes written by the send probe
+	Expect   string        `json:"expect" mapstructure:"expect" yaml:"expect"` // prefix the send probe expects in the response
+	Path     string        `json:"path" mapstructure:"path" yaml:"path"`       // path of the http probe, a 2xx or 3xx status is healthy
+}
+
+// OutlierDetectionConfig passive ejection of the remote addresses which keep failing the proxied connections,
+// a negative consecutivefailures disables it
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures int           `json:"consecutivefailures" mapstructure:"consecutivefailures" yaml:"consecutivefailures"` // dial or io failures in a row to eject
+	BaseEjectionTime    time.Duration `json:"baseejectiontime" mapstructure:"baseejectiontime" yaml:"baseejectiontime"`          // doubled by every ejection in a row
+	MaxEjectionTime     time.Duration `json:"maxejectiontime" mapstructure:"maxejectiontime" yaml:"maxejectiontime"`
+	HalfOpenTrials      int           `json:"halfopentrials" mapstructure:"halfopentrials" yaml:"halfopentrials"` // concurrent trial connections after an ejection
+}
+
+// Enabled whether the remote addresses are ejected at all
+func (od OutlierDetectionConfig) Enabled() bool {
+	return od.ConsecutiveFailures > 0
+}
+
+// The types of the active health check
+const (
+	HEALTHCHECKTCP  = "tcp"  // connect only
+	HEALTHCHECKSEND = "send" // connect, send and expect
+	HEALTHCHECKHTTP = "http" // http GET
+)
+
+// The types of the groups
+const (
+	GROUPTCP = "tcp"
+	GROUPUDP = "udp" // every client address is a flow, which expires after rwtimeout without any datagram
+)
+
+// The versions of the PROXY protocol
+const (
+	PROXYV1  = "v1"
+	PROXYV2  = "v2"
+	PROXYANY = "any" // accepts both versions
+)
+
+// The hash keys of the hashing lb policies
+const (
+	HASHKEYIP      = "ip"     // source ip without the port
+	HASHKEYADDRESS = "addr"   // source ip and port
+	HASHKEYPREFIX  = "prefix" // source ip network, /hashprefix for IPv4 and /hashprefix6 for IPv6
+	HASHKEYPROXY   = "proxy"  // client ip from the PROXY protocol header, it needs acceptproxy
+	HASHKEYSNI     = "sni"    // TLS server name from the ClientHello
+)
+
 // System configuration parameters
 var (
-	conf ProxyConfig
-	once sync.Once
+	conf     ProxyConfig
+	once     sync.Once
+	confLock sync.RWMutex
 )
 
 //
@@ -62,10 +155,332 @@ func InitConfig() {
 	if err := viper.Unmarshal(&conf); err != nil {
 		log.Panicln("Error to unmarshal config, error:", err)
 	}
+
+	if err := conf.Validate(); err != nil {
+		log.Panicln("Error to validate config, error:", err)
+	}
 }
 
 // GetConfig get the system config
 func GetConfig() ProxyConfig {
 	once.Do(InitConfig)
+
+	confLock.RLock()
+	defer confLock.RUnlock()
 	return conf
 }
+
+// Reload reads the config file again, the new config is only in force when it passes the validation
+func Reload() (ProxyConfig, error) {
+	once.Do(InitConfig)
+
+	// A separate viper keeps the global one untouched when the file is broken
+	v := viper.New()
+	v.SetConfigFile(viper.ConfigFileUsed())
+	v.SetConfigType("json")
+	if err := v.ReadInConfig(); err != nil {
+		return GetConfig(), errors.WithMessage(err, "Error to read config file")
+	}
+
+	var newConf ProxyConfig
+	if err := v.Unmarshal(&newConf); err != nil {
+		return GetConfig(), errors.WithMessage(err, "Error to unmarshal config")
+	}
+
+	if err := newConf.Validate(); err != nil {
+		return GetConfig(), errors.WithMessage(err, "Error to validate config")
+	}
+
+	confLock.Lock()
+	defer confLock.Unlock()
+	conf = newConf
+	return conf, nil
+}
+
+// WatchConfig calls onChange every time the config file is written
+func WatchConfig(onChange func()) {
+	once.Do(InitConfig)
+
+	viper.OnConfigChange(func(event fsnotify.Event) {
+		log.Println("Config file changed:", event.Name)
+		onChange()
+	})
+	viper.WatchConfig()
+}
+
+// Validate checks the global settings and every group
+func (conf ProxyConfig) Validate() error {
+	if conf.RWTimeout <= 0 {
+		return errors.Errorf("rwtimeout must be positive, got %s", conf.RWTimeout)
+	}
+	if conf.HandleBuffer <= 0 {
+		return errors.Errorf("handlebuffer must be positive, got %d", conf.HandleBuffer)
+	}
+
+	names := make(map[string]struct{})
+	for _, group := range conf.GroupConfigs() {
+		if err := group.Validate(); err != nil {
+			return err
+		}
+
+		if _, ok := names[group.Name]; ok {
+			return errors.Errorf("group %s is configured more than once", group.Name)
+		}
+		names[group.Name] = struct{}{}
+	}
+	return nil
+}
+
+// Validate checks the settings of the group
+func (group GroupConfig) Validate() error {
+	if group.Listen == "" {
+		return errors.Errorf("group %s has no listen port", group.Name)
+	}
+	if _, ok := lb.PolicyNames[group.LBPolicy]; !ok || group.LBPolicy == int(lb.UNKNOWN) {
+		return errors.Errorf("group %s has an unknown lbpolicy %d", group.Name, group.LBPolicy)
+	}
+	if group.RWTimeout <= 0 {
+		return errors.Errorf("group %s rwtimeout must be positive, got %s", group.Name, group.RWTimeout)
+	}
+	if group.HandleBuffer <= 0 {
+		return errors.Errorf("group %s handlebuffer must be positive, got %d", group.Name, group.HandleBuffer)
+	}
+	if group.DefaultWeight <= 0 {
+		return errors.Errorf("group %s defaultweight must be positive, got %d", group.Name, group.DefaultWeight)
+	}
+	switch group.HashKey {
+	case HASHKEYIP, HASHKEYADDRESS, HASHKEYPREFIX, HASHKEYPROXY, HASHKEYSNI:
+	default:
+		return errors.Errorf("group %s has an unknown hashkey %q", group.Name, group.HashKey)
+	}
+	if group.HashPrefix < 0 || group.HashPrefix > 32 || group.HashPrefix6 < 0 || group.HashPrefix6 > 128 {
+		return errors.Errorf("group %s hashprefix must be in [0, 32] and hashprefix6 in [0, 128]", group.Name)
+	}
+	switch group.AcceptProxy {
+	case "", PROXYV1, PROXYV2, PROXYANY:
+	default:
+		return errors.Errorf("group %s has an unknown acceptproxy %q", group.Name, group.AcceptProxy)
+	}
+	if group.HashKey == HASHKEYPROXY && group.AcceptProxy == "" {
+		// A header which is not accepted would be forwarded to the backend as payload
+		return errors.Errorf("group %s hashkey proxy needs acceptproxy", group.Name)
+	}
+	switch group.SendProxy {
+	case "", PROXYV1, PROXYV2:
+	default:
+		return errors.Errorf("group %s has an unknown sendproxy %q", group.Name, group.SendProxy)
+	}
+	switch group.Type {
+	case GROUPTCP:
+	case GROUPUDP:
+		if err := group.validateUDP(); err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("group %s", group.Name))
+		}
+	default:
+		return errors.Errorf("group %s has an unknown type %q", group.Name, group.Type)
+	}
+	if err := group.validateBind(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s", group.Name))
+	}
+	if err := group.validateUnix(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s", group.Name))
+	}
+	if err := group.HealthCheck.Validate(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s healthcheck", group.Name))
+	}
+	if err := group.OutlierDetection.Validate(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s outlierdetection", group.Name))
+	}
+	if err := group.Limits.Validate(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s limits", group.Name))
+	}
+	if err := group.ACL.Validate(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s acl", group.Name))
+	}
+	if err := group.TLS.Validate(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s tls", group.Name))
+	}
+	if err := group.BackendTLS.Validate(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("group %s backendtls", group.Name))
+	}
+	return errors.WithMessage(group.validateRoutes(), fmt.Sprintf("group %s routes", group.Name))
+}
+
+// validateUDP rejects the settings which need a stream
+func (group GroupConfig) validateUDP() error {
+	switch {
+	case group.AcceptProxy != "" || group.SendProxy != "":
+		return errors.New("udp type has no PROXY header")
+	case group.TLS.Enabled() || group.BackendTLS.Enabled():
+		return errors.New("udp type has no tls")
+	case len(group.Routes) > 0:
+		return errors.New("udp type has no routes")
+	case group.HashKey == HASHKEYPROXY || group.HashKey == HASHKEYSNI:
+		return errors.Errorf("udp type has no hashkey %s", group.HashKey)
+	case group.HealthCheck.Type != "":
+		return errors.New("udp type has no healthcheck, the probes are tcp")
+	}
+	return nil
+}
+
+// Validate checks the settings of the health check
+func (hc HealthCheckConfig) Validate() error {
+	switch hc.Type {
+	case "":
+		return nil
+	case HEALTHCHECKTCP, HEALTHCHECKHTTP:
+	case HEALTHCHECKSEND:
+		if hc.Send == "" {
+			return errors.New("the send probe has nothing to send")
+		}
+	default:
+		return errors.Errorf("unknown type %q", hc.Type)
+	}
+
+	if hc.Interval <= 0 || hc.Timeout <= 0 || hc.Rise <= 0 || hc.Fall <= 0 {
+		return errors.New("interval, timeout, rise and fall must be positive")
+	}
+	return nil
+}
+
+// Validate checks the settings of the outlier detection
+func (od OutlierDetectionConfig) Validate() error {
+	if !od.Enabled() {
+		return nil
+	}
+
+	if od.BaseEjectionTime <= 0 || od.HalfOpenTrials <= 0 {
+		return errors.New("baseejectiontime and halfopentrials must be positive")
+	}
+	if od.MaxEjectionTime < od.BaseEjectionTime {
+		return errors.Errorf("maxejectiontime %s is less than baseejectiontime %s", od.MaxEjectionTime, od.BaseEjectionTime)
+	}
+	return nil
+}
+
+// GroupConfigs returns every configured group with the global settings filled in,
+// the tcpport is used as the only group when the groups section is empty
+func (conf ProxyConfig) GroupConfigs() []GroupConfig {
+	if len(conf.Groups) == 0 {
+		return []GroupConfig{conf.NewGroupConfig(conf.TCPPort)}
+	}
+
+	groups := make([]GroupConfig, 0, len(conf.Groups))
+	for _, group := range conf.Groups {
+		groups = append(groups, conf.withDefaults(group))
+	}
+	return groups
+}
+
+// FindGroup returns the configured settings of the group named name
+func (conf ProxyConfig) FindGroup(name string) (GroupConfig, bool) {
+	for _, group := range conf.GroupConfigs() {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return GroupConfig{}, false
+}
+
+// NewGroupConfig returns the settings of a group listening on the port, it inherits all the global settings
+func (conf ProxyConfig) NewGroupConfig(listen string) GroupConfig {
+	return conf.withDefaults(GroupConfig{Listen: listen})
+}
+
+func (conf ProxyConfig) withDefaults(group GroupConfig) GroupConfig {
+	if group.Name == "" {
+		group.Name = group.Listen
+	}
+	if group.Type == "" {
+		group.Type = GROUPTCP
+	}
+	if group.Bind == "" {
+		group.Bind = conf.Bind
+	}
+	if group.Bind == "" {
+		group.Bind = BINDLOCALHOST
+	}
+	if group.LBPolicy == 0 {
+		group.LBPolicy = conf.LBPolicy
+	}
+	if group.RWTimeout == 0 {
+		group.RWTimeout = conf.RWTimeout
+	}
+	if group.HandleBuffer == 0 {
+		group.HandleBuffer = conf.HandleBuffer
+	}
+	if group.DefaultWeight == 0 {
+		group.DefaultWeight = conf.DefaultWeight
+	}
+	if group.DefaultWeight == 0 {
+		group.DefaultWeight = 1
+	}
+	if group.HashKey == "" {
+		group.HashKey = HASHKEYIP
+	}
+	if group.HashPrefix == 0 {
+		group.HashPrefix = 24
+	}
+	if group.HashPrefix6 == 0 {
+		group.HashPrefix6 = 64
+	}
+	if group.Retries == 0 {
+		group.Retries = 2
+	}
+	if group.DrainTimeout == 0 {
+		group.DrainTimeout = conf.DrainTimeout
+	}
+	if group.DrainTimeout == 0 {
+		group.DrainTimeout = 30 * time.Second
+	}
+	group.HealthCheck = group.HealthCheck.withDefaults()
+	group.OutlierDetection = group.OutlierDetection.withDefaults()
+	group.Limits = group.Limits.withDefaults()
+	return group
+}
+
+func (hc HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if hc.Type == "" {
+		return hc
+	}
+
+	if hc.Interval == 0 {
+		hc.Interval = 2 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = time.Second
+	}
+	if hc.Rise == 0 {
+		hc.Rise = 2
+	}
+	if hc.Fall == 0 {
+		hc.Fall = 3
+	}
+	if hc.Type == HEALTHCHECKHTTP && hc.Path == "" {
+		hc.Path = "/"
+	}
+	return hc
+}
+
+func (od OutlierDetectionConfig) withDefaults() OutlierDetectionConfig {
+	if od.ConsecutiveFailures < 0 {
+		return od
+	}
+
+	if od.ConsecutiveFailures == 0 {
+		od.ConsecutiveFailures = 5
+	}
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = 10 * time.Second
+	}
+	if od.MaxEjectionTime == 0 {
+		od.MaxEjectionTime = 5 * time.Minute
+	}
+	if od.MaxEjectionTime < od.BaseEjectionTime {
+		od.MaxEjectionTime = od.BaseEjectionTime
+	}
+	if od.HalfOpenTrials == 0 {
+		od.HalfOpenTrials = 1
+	}
+	return od
+}
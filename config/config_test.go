@@ -1,11 +1,18 @@
 package config
 
 import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/wangff15386/goproxy/services/lb"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,9 +28,205 @@ func Test_Config(t *testing.T) {
 	assert.Equal(t, 25*time.Second/10, conf.AliveCheckInterval)
 	assert.Equal(t, 1024, conf.HandleBuffer)
 
+	groups := conf.GroupConfigs()
+	assert.Equal(t, 1, len(groups))
+	assert.Equal(t, GroupConfig{Name: "8081", Listen: "8081", Type: GROUPTCP, Bind: BINDLOCALHOST, LBPolicy: 1, RWTimeout: 3 * time.Second, HandleBuffer: 1024, DefaultWeight: 1, HashKey: HASHKEYIP, HashPrefix: 24, HashPrefix6: 64, Retries: 2, DrainTimeout: 30 * time.Second, OutlierDetection: outlierDetectionForTests}, groups[0])
+
 	conf1 := GetConfig()
 	assert.Equal(t, conf, conf1)
 
 	conf1.HTTPPort = "7777"
 	assert.Equal(t, "8080", conf.HTTPPort)
 }
+
+var outlierDetectionForTests = OutlierDetectionConfig{ConsecutiveFailures: 5, BaseEjectionTime: 10 * time.Second, MaxEjectionTime: 5 * time.Minute, HalfOpenTrials: 1}
+
+func Test_GroupConfigs(t *testing.T) {
+	conf := ProxyConfig{TCPPort: "8081", LBPolicy: 3, RWTimeout: time.Second, HandleBuffer: 512}
+	assert.Equal(t, []GroupConfig{{Name: "8081", Listen: "8081", Type: GROUPTCP, Bind: BINDLOCALHOST, LBPolicy: 3, RWTimeout: time.Second, HandleBuffer: 512, DefaultWeight: 1, HashKey: HASHKEYIP, HashPrefix: 24, HashPrefix6: 64, Retries: 2, DrainTimeout: 30 * time.Second, OutlierDetection: outlierDetectionForTests}}, conf.GroupConfigs())
+
+	conf.Groups = []GroupConfig{{Listen: "9000", HealthCheck: HealthCheckConfig{Type: HEALTHCHECKHTTP}}}
+	assert.Equal(t, HealthCheckConfig{Type: HEALTHCHECKHTTP, Interval: 2 * time.Second, Timeout: time.Second, Rise: 2, Fall: 3, Path: "/"}, conf.GroupConfigs()[0].HealthCheck)
+	assert.NoError(t, conf.Validate())
+
+	conf.Groups = []GroupConfig{{Listen: "9000", OutlierDetection: OutlierDetectionConfig{ConsecutiveFailures: -1}}}
+	assert.False(t, conf.GroupConfigs()[0].OutlierDetection.Enabled())
+	assert.NoError(t, conf.Validate())
+
+	conf.DefaultWeight = 4
+	group := conf.NewGroupConfig("9000")
+	assert.Equal(t, GroupConfig{Name: "9000", Listen: "9000", Type: GROUPTCP, Bind: BINDLOCALHOST, LBPolicy: 3, RWTimeout: time.Second, HandleBuffer: 512, DefaultWeight: 4, HashKey: HASHKEYIP, HashPrefix: 24, HashPrefix6: 64, Retries: 2, DrainTimeout: 30 * time.Second, OutlierDetection: outlierDetectionForTests}, group)
+}
+
+func Test_Reload(t *testing.T) {
+	GetConfig()
+	original := viper.ConfigFileUsed()
+	defer viper.SetConfigFile(original)
+
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, CONFFILENAME+".json")
+	viper.SetConfigFile(path)
+
+	data := `{"tcpport": "9000", "lbpolicy": 2, "rwtimeout": "1s", "handlebuffer": 64}`
+	assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	newConf, err := Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, "9000", newConf.TCPPort)
+	assert.Equal(t, newConf, GetConfig())
+
+	// the groups are decoded with their nested settings
+	data = `{"tcpport": "9000", "lbpolicy": 2, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{
+		"name": "web", "listen": "9002", "rwtimeout": "30s", "draintimeout": "5s",
+		"servers": ["127.0.0.1:8080", "127.0.0.1:8081"],
+		"healthcheck": {"type": "tcp", "interval": "2s", "timeout": "500ms", "rise": 2, "fall": 3},
+		"outlierdetection": {"consecutivefailures": 5, "baseejectiontime": "30s", "maxejectiontime": "5m"},
+		"tls": {"certfile": "cert.pem", "keyfile": "key.pem", "minversion": "1.3"},
+		"pools": [{"name": "h2", "servers": ["127.0.0.1:8443"]}],
+		"routes": [{"alpn": ["h2"], "pool": "h2"}],
+		"limits": {"maxsessions": 100, "queue": 10, "queuetimeout": "2s"},
+		"acl": {"allow": ["10.0.0.0/8"], "deny": ["10.1.0.0/16"]}
+	}]}`
+	assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	newConf, err = Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []GroupConfig{{
+		Name:         "web",
+		Listen:       "9002",
+		RWTimeout:    30 * time.Second,
+		DrainTimeout: 5 * time.Second,
+		Servers:      []string{"127.0.0.1:8080", "127.0.0.1:8081"},
+		HealthCheck:  HealthCheckConfig{Type: "tcp", Interval: 2 * time.Second, Timeout: 500 * time.Millisecond, Rise: 2, Fall: 3},
+		OutlierDetection: OutlierDetectionConfig{
+			ConsecutiveFailures: 5, BaseEjectionTime: 30 * time.Second, MaxEjectionTime: 5 * time.Minute,
+		},
+		TLS:    TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.3"},
+		Pools:  []PoolConfig{{Name: "h2", Servers: []string{"127.0.0.1:8443"}}},
+		Routes: []RouteConfig{{ALPN: []string{"h2"}, Pool: "h2"}},
+		Limits: LimitsConfig{MaxSessions: 100, Queue: 10, QueueTimeout: 2 * time.Second},
+		ACL:    ACLConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}},
+	}}, newConf.Groups)
+	assert.Equal(t, newConf, GetConfig())
+
+	// a broken or invalid file is rejected and the old config stays in force
+	for _, data := range []string{
+		`{`,
+		`{"tcpport": "9001", "lbpolicy": 9, "rwtimeout": "1s", "handlebuffer": 64}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001"}, {"listen": "9001"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "hashkey": "cookie"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "sendproxy": "any"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "hashkey": "proxy"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "tls": {"certfile": "cert.pem"}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "tls": {"certfile": "cert.pem", "keyfile": "key.pem", "minversion": "1.4"}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "tls": {"certfile": "cert.pem", "keyfile": "key.pem", "ciphersuites": ["TLS_NULL"]}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "backendtls": {"cafile": "ca.pem"}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "backendtls": {"enable": true, "certfile": "client.pem"}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "routes": [{"servernames": ["a.example.com"], "pool": "a"}]}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "pools": [{"name": "a"}]}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "routes": [{"servernames": ["a.*.com"]}]}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "type": "sctp"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "unix:"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "bind": "example.com"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "limits": {"maxsessions": -1}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "limits": {"queue": 8}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "acl": {"deny": ["10.0.0.0/33"]}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "acl": {"allow": ["example.com"]}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "type": "udp", "servers": ["unix:/run/dns.sock"]}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "type": "udp", "sendproxy": "v2"}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "healthcheck": {"type": "send"}}]}`,
+		`{"lbpolicy": 1, "rwtimeout": "1s", "handlebuffer": 64, "groups": [{"listen": "9001", "outlierdetection": {"baseejectiontime": "-1s"}}]}`,
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		_, err = Reload()
+		assert.Error(t, err)
+		assert.Equal(t, newConf, GetConfig())
+	}
+
+	viper.SetConfigFile(original)
+	_, err = Reload()
+	assert.NoError(t, err)
+}
+
+func Test_TLSConfig(t *testing.T) {
+	c := TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}
+	assert.NoError(t, c.Validate())
+	version, err := c.Version()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+
+	c.MinVersion = "1.3"
+	c.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	version, err = c.Version()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+	ciphers, err := c.Ciphers()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, ciphers)
+
+	assert.Error(t, TLSConfig{ClientCAFile: "ca.pem"}.Validate())
+}
+
+func Test_Route(t *testing.T) {
+	group := GroupConfig{
+		Pools: []PoolConfig{{Name: "web", Servers: []string{"127.0.0.1:443"}}, {Name: "h2", Servers: []string{"127.0.0.1:8443"}}},
+		Routes: []RouteConfig{
+			{ServerNames: []string{"*.example.com"}, ALPN: []string{"h2"}, Pool: "h2"},
+			{ServerNames: []string{"www.example.com", "*.example.com"}, Pool: "web"},
+			{ServerNames: []string{"legacy.example.com"}},
+		},
+	}
+	assert.NoError(t, group.validateRoutes())
+
+	assert.Equal(t, "h2", group.Route("api.example.com", []string{"h2", "http/1.1"}))
+	assert.Equal(t, "web", group.Route("API.Example.com.", []string{"http/1.1"}))
+	assert.Equal(t, "web", group.Route("www.example.com", nil))
+	assert.Equal(t, "", group.Route("a.b.example.com", nil))
+	assert.Equal(t, "", group.Route("example.com", []string{"h2"}))
+	assert.Equal(t, "", group.Route("", nil))
+}
+
+func Test_ListenAddress(t *testing.T) {
+	conf := ProxyConfig{Bind: "0.0.0.0"}
+	for bind, address := range map[string]string{
+		"":          "0.0.0.0:9001",
+		"localhost": "localhost:9001",
+		"*":         ":9001",
+		"::1":       "[::1]:9001",
+		"[::]":      "[::]:9001",
+		"fe80::1%2": "[fe80::1%2]:9001",
+	} {
+		group := conf.withDefaults(GroupConfig{Listen: "9001", Bind: bind})
+		assert.NoError(t, group.validateBind())
+		assert.Equal(t, address, group.ListenAddress())
+	}
+
+	group := conf.withDefaults(GroupConfig{Listen: "unix:/run/proxy.sock", Bind: "::1"})
+	assert.Equal(t, "unix:/run/proxy.sock", group.ListenAddress())
+	assert.Equal(t, BINDLOCALHOST, ProxyConfig{}.NewGroupConfig("9001").Bind)
+}
+
+func Test_ACL(t *testing.T) {
+	acl := ACLConfig{Allow: []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"}, Deny: []string{"10.1.0.0/16"}}
+	assert.NoError(t, acl.Validate())
+
+	for ip, expected := range map[string]string{
+		"10.2.3.4":         "allow 10.0.0.0/8",
+		"10.1.2.3":         "deny 10.1.0.0/16",
+		"2001:db8::1":      "allow 2001:db8::/32",
+		"::ffff:10.2.3.4":  "allow 10.0.0.0/8",
+		"192.168.1.1":      "allow 192.168.1.1",
+		"192.168.1.2":      ACLIMPLICITDENY,
+		"2001:db9::1":      ACLIMPLICITDENY,
+		"not an ip at all": ACLIMPLICITDENY,
+	} {
+		ok, rule := acl.Check(net.ParseIP(ip))
+		assert.Equal(t, expected, rule, ip)
+		assert.Equal(t, strings.HasPrefix(expected, "allow"), ok, ip)
+	}
+
+	// without allow rules every client not denied is allowed
+	ok, rule := ACLConfig{Deny: []string{"10.1.0.0/16"}}.Check(net.ParseIP("10.2.3.4"))
+	assert.True(t, ok)
+	assert.Equal(t, "", rule)
+}
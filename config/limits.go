@@ -0,0 +1,43 @@
+package config
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LimitsConfig caps the sessions of a group, the zero values are no limit. A session over a limit is refused
+// at once, or waits for queuetimeout in the accept queue when the queue is not full
+type LimitsConfig struct {
+	MaxSessions      int           `json:"maxsessions" mapstructure:"maxsessions" yaml:"maxsessions"`                // concurrent sessions of the group
+	MaxSessionsPerIP int           `json:"maxsessionsperip" mapstructure:"maxsessionsperip" yaml:"maxsessionsperip"` // concurrent sessions of one client ip
+	MaxRatePerIP     int           `json:"maxrateperip" mapstructure:"maxrateperip" yaml:"maxrateperip"`             // new sessions per second of one client ip
+	Queue            int           `json:"queue" mapstructure:"queue" yaml:"queue"`                                  // sessions waiting for a free slot, 0 refuses them at once
+	QueueTimeout     time.Duration `json:"queuetimeout" mapstructure:"queuetimeout" yaml:"queuetimeout"`             // how long a session waits in the queue, defaults to 1s
+}
+
+// Enabled whether any limit is configured
+func (c LimitsConfig) Enabled() bool {
+	return c.MaxSessions > 0 || c.MaxSessionsPerIP > 0 || c.MaxRatePerIP > 0
+}
+
+// Validate checks the limits of the group
+func (c LimitsConfig) Validate() error {
+	if c.MaxSessions < 0 || c.MaxSessionsPerIP < 0 || c.MaxRatePerIP < 0 {
+		return errors.New("maxsessions, maxsessionsperip and maxrateperip must not be negative")
+	}
+	if c.Queue < 0 || c.QueueTimeout < 0 {
+		return errors.New("queue and queuetimeout must not be negative")
+	}
+	if c.Queue > 0 && !c.Enabled() {
+		return errors.New("queue needs a limit")
+	}
+	return nil
+}
+
+func (c LimitsConfig) withDefaults() LimitsConfig {
+	if c.Queue > 0 && c.QueueTimeout == 0 {
+		c.QueueTimeout = time.Second
+	}
+	return c
+}
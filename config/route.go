@@ -0,0 +1,105 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PoolConfig a named set of static remote addresses a route sends the sessions to
+type PoolConfig struct {
+	Name    string   `json:"name" mapstructure:"name" yaml:"name"`
+	Servers []string `json:"servers" mapstructure:"servers" yaml:"servers"`
+}
+
+// RouteConfig picks the pool of a session from its TLS ClientHello, a route matches when the server name
+// matches one of servernames and one of the alpn protocols is offered, an empty list matches anything.
+// An empty pool is the default pool of the group: its servers and the workers registered by heartbeats
+type RouteConfig struct {
+	ServerNames []string `json:"servernames" mapstructure:"servernames" yaml:"servernames"` // exact names or wildcards like *.example.com
+	ALPN        []string `json:"alpn" mapstructure:"alpn" yaml:"alpn"`
+	Pool        string   `json:"pool" mapstructure:"pool" yaml:"pool"`
+}
+
+// Match reports whether the session with the server name and the offered protocols takes the route
+func (route RouteConfig) Match(serverName string, protocols []string) bool {
+	return route.matchServerName(serverName) && route.matchALPN(protocols)
+}
+
+func (route RouteConfig) matchServerName(serverName string) bool {
+	if len(route.ServerNames) == 0 {
+		return true
+	}
+
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for _, pattern := range route.ServerNames {
+		pattern = strings.ToLower(pattern)
+		if pattern == serverName {
+			return true
+		}
+		// A wildcard matches exactly one label, like the certificates do
+		if strings.HasPrefix(pattern, "*.") {
+			if i := strings.Index(serverName, "."); i > 0 && serverName[i:] == pattern[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (route RouteConfig) matchALPN(protocols []string) bool {
+	if len(route.ALPN) == 0 {
+		return true
+	}
+
+	for _, wanted := range route.ALPN {
+		for _, protocol := range protocols {
+			if protocol == wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Route returns the pool of the first matching route, the default pool when none matches
+func (group GroupConfig) Route(serverName string, protocols []string) string {
+	for _, route := range group.Routes {
+		if route.Match(serverName, protocols) {
+			return route.Pool
+		}
+	}
+	return ""
+}
+
+// validateRoutes checks the pools and that every route goes to one of them
+func (group GroupConfig) validateRoutes() error {
+	pools := make(map[string]struct{})
+	for _, pool := range group.Pools {
+		if pool.Name == "" {
+			return errors.New("pool has no name")
+		}
+		if _, ok := pools[pool.Name]; ok {
+			return errors.Errorf("pool %s is declared more than once", pool.Name)
+		}
+		if len(pool.Servers) == 0 {
+			return errors.Errorf("pool %s has no servers", pool.Name)
+		}
+		pools[pool.Name] = struct{}{}
+	}
+
+	for i, route := range group.Routes {
+		if len(route.ServerNames) == 0 && len(route.ALPN) == 0 {
+			return errors.Errorf("route %d needs servernames or alpn", i)
+		}
+		for _, pattern := range route.ServerNames {
+			if pattern == "" || strings.Contains(pattern[1:], "*") || (strings.HasPrefix(pattern, "*") && !strings.HasPrefix(pattern, "*.")) {
+				return errors.Errorf("route %d has an invalid server name %q", i, pattern)
+			}
+		}
+		if _, ok := pools[route.Pool]; route.Pool != "" && !ok {
+			return errors.Errorf("route %d goes to an unknown pool %s", i, route.Pool)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// STATEFILENAME the sidecar state file next to the config file
+const STATEFILENAME = "proxy.state.json"
+
+// State the changes made through the http api, they take effect on the next restart
+type State struct {
+	Opened  []GroupConfig        `json:"opened"`  // groups opened by group-open.do
+	Closed  []string             `json:"closed"`  // configured groups closed by group-close.do
+	Workers map[string][]string  `json:"workers"` // workers registered by worker-keepalive.do of each group
+	ACLs    map[string]ACLConfig `json:"acls"`    // acls set by acl-set.do of each group, they replace the acl of the config until it is reloaded
+
+	PoolWorkers map[string]map[string][]string `json:"poolworkers"` // workers registered to the named pools of each group
+}
+
+// StatePath returns the path of the state file, it defaults to the directory of the config file
+func StatePath() string {
+	if conf := GetConfig(); conf.StateFile != "" {
+		return conf.StateFile
+	}
+
+	return filepath.Join(filepath.Dir(viper.ConfigFileUsed()), STATEFILENAME)
+}
+
+// LoadState reads the state file, a missing file is an empty state
+func LoadState(path string) (State, error) {
+	state := State{Workers: make(map[string][]string)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, errors.WithMessage(err, "Error to read state file")
+	}
+
+	if err = json.Unmarshal(data, &state); err != nil {
+		return state, errors.WithMessage(err, "Error to unmarshal state file")
+	}
+	if state.Workers == nil {
+		state.Workers = make(map[string][]string)
+	}
+	return state, nil
+}
+
+// SaveState writes the state file atomically, a crash leaves either the old or the new file
+func SaveState(path string, state State) error {
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return errors.WithMessage(err, "Error to marshal state")
+	}
+
+	// The temp file must be on the same file system for the rename to be atomic
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.WithMessage(err, "Error to create temp state file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.WithMessage(err, "Error to write temp state file")
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.WithMessage(err, "Error to sync temp state file")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.WithMessage(err, "Error to close temp state file")
+	}
+
+	return errors.WithMessage(os.Rename(tmp.Name(), path), "Error to rename state file")
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_State(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, STATEFILENAME)
+
+	// a missing file is an empty state
+	state, err := LoadState(path)
+	assert.NoError(t, err)
+	assert.Empty(t, state.Opened)
+	assert.Empty(t, state.Closed)
+	assert.NotNil(t, state.Workers)
+
+	state.Opened = []GroupConfig{{Name: "9000", Listen: "9000", LBPolicy: 2, RWTimeout: time.Second, HandleBuffer: 512}}
+	state.Closed = []string{"8081"}
+	state.Workers["9000"] = []string{"127.0.0.1:11111"}
+	assert.NoError(t, SaveState(path, state))
+
+	state1, err := LoadState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, state, state1)
+
+	// no temp file is left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = LoadState(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig terminates TLS on the listener of a group, the backends get the plaintext.
+// An empty certfile disables it
+type TLSConfig struct {
+	CertFile     string   `json:"certfile" mapstructure:"certfile" yaml:"certfile"` // PEM certificate chain, reloaded when the file changes
+	KeyFile      string   `json:"keyfile" mapstructure:"keyfile" yaml:"keyfile"`
+	MinVersion   string   `json:"minversion" mapstructure:"minversion" yaml:"minversion"`       // 1.0, 1.1, 1.2 or 1.3, defaults to 1.2
+	CipherSuites []string `json:"ciphersuites" mapstructure:"ciphersuites" yaml:"ciphersuites"` // names of crypto/tls, TLS 1.3 suites are not configurable
+	ClientCAFile string   `json:"clientcafile" mapstructure:"clientcafile" yaml:"clientcafile"` // PEM CA bundle, the clients must present a certificate signed by it
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Enabled whether the listener terminates TLS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// Version returns the minimum version, TLS 1.2 when not configured
+func (c TLSConfig) Version() (uint16, error) {
+	if c.MinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	version, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return 0, errors.Errorf("unknown minversion %q", c.MinVersion)
+	}
+	return version, nil
+}
+
+// Ciphers returns the ids of the cipher suites, nil for the defaults of crypto/tls
+func (c TLSConfig) Ciphers() ([]uint16, error) {
+	if len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+
+	ids := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+
+	ciphers := make([]uint16, 0, len(c.CipherSuites))
+	for _, name := range c.CipherSuites {
+		id, ok := ids[name]
+		if !ok {
+			return nil, errors.Errorf("unknown cipher suite %q", name)
+		}
+		ciphers = append(ciphers, id)
+	}
+	return ciphers, nil
+}
+
+// Validate checks the settings of the TLS termination, the files are read when the group starts
+func (c TLSConfig) Validate() error {
+	if !c.Enabled() {
+		if c.KeyFile != "" || c.ClientCAFile != "" {
+			return errors.New("keyfile and clientcafile need a certfile")
+		}
+		return nil
+	}
+
+	if c.KeyFile == "" {
+		return errors.New("certfile needs a keyfile")
+	}
+	if _, err := c.Version(); err != nil {
+		return err
+	}
+	_, err := c.Ciphers()
+	return err
+}
+
+// BackendTLSConfig dials the backends of a group over TLS, a failed handshake is a failed dial
+type BackendTLSConfig struct {
+	Enable             bool   `json:"enable" mapstructure:"enable" yaml:"enable"`
+	CAFile             string `json:"cafile" mapstructure:"cafile" yaml:"cafile"`       // PEM CA bundle verifying the backends, the system roots when empty
+	CertFile           string `json:"certfile" mapstructure:"certfile" yaml:"certfile"` // PEM client certificate for mTLS, reloaded when the file changes
+	KeyFile            string `json:"keyfile" mapstructure:"keyfile" yaml:"keyfile"`
+	ServerName         string `json:"servername" mapstructure:"servername" yaml:"servername"`                         // SNI and verified name, the host of the backend address when empty
+	InsecureSkipVerify bool   `json:"insecureskipverify" mapstructure:"insecureskipverify" yaml:"insecureskipverify"` // accepts any backend certificate, for labs only
+}
+
+// Enabled whether the backends are dialed over TLS
+func (c BackendTLSConfig) Enabled() bool {
+	return c.Enable
+}
+
+// Validate checks the settings of the backend TLS, the files are read when the group starts
+func (c BackendTLSConfig) Validate() error {
+	if !c.Enabled() {
+		if c != (BackendTLSConfig{}) {
+			return errors.New("the settings need enable")
+		}
+		return nil
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("certfile and keyfile must be given together")
+	}
+	return nil
+}
@@ -3,17 +3,36 @@ package api
 import (
 	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/wangff15386/goproxy/config"
 	"github.com/wangff15386/goproxy/services/service"
 )
 
-// KeepAliveServer worker-keepalive.do?group=<监听端口>&server=<host>:<port> 接收服务器注册和心跳 更新在线服务器列表
+// KeepAliveServer worker-keepalive.do?group=<监听端口>&server=<host>:<port>[&weight=<权重>][&pool=<服务器池>] 接收服务器注册和心跳 更新在线服务器列表,
+// a heartbeat without weight keeps the registered weight and weight=0 resets it to the default weight
 func KeepAliveServer(c *gin.Context) {
-	tcpPort, remoteAddress := c.Query("group"), c.Query("server")
-	err := service.SendKeepAlivePackage(tcpPort, remoteAddress)
+	tcpPort, remoteAddress, pool := c.Query("group"), c.Query("server"), c.Query("pool")
+
+	weight := 0
+	if value := c.Query("weight"); value != "" {
+		var err error
+		if weight, err = strconv.Atoi(value); err != nil {
+			response(c, gin.H{"ok": false, "msg": fmt.Sprintf("invalid weight %q", value)})
+			return
+		}
+		if weight == 0 {
+			weight = service.WEIGHTRESET
+		} else if weight < 0 {
+			response(c, gin.H{"ok": false, "msg": fmt.Sprintf("invalid weight %q", value)})
+			return
+		}
+	}
+
+	err := service.KeepAlive(tcpPort, pool, remoteAddress, weight)
 	if err != nil {
 		response(c, gin.H{"ok": false, "msg": err.Error()})
 		return
@@ -22,42 +41,129 @@ func KeepAliveServer(c *gin.Context) {
 	response(c, gin.H{"ok": true})
 }
 
-// GetList worker-list.do?group=<监听端口> 查看在线服务器列表
+// GetList worker-list.do?group=<监听端口> 查看在线服务器列表, 不带group参数时返回所有分组
 func GetList(c *gin.Context) {
-	tcpPort := c.Query("group")
-	list, err := service.SendGetAllAliveServerAddressesPackage(tcpPort)
+	group := c.Query("group")
+	if group == "" {
+		list := make([]gin.H, 0)
+		for _, name := range service.GetAllGroups() {
+			if info, err := groupInfo(name); err == nil {
+				list = append(list, info)
+			}
+		}
+
+		response(c, gin.H{"ok": true, "groups": list, "draining": service.GetAllDrainStatus()})
+		return
+	}
+
+	info, err := groupInfo(group)
 	if err != nil {
+		// A closed group reports its drain progress until its sessions are finished
+		if status, ok := service.GetDrainStatus(group); ok {
+			response(c, gin.H{"ok": true, "group": group, "draining": status})
+			return
+		}
+
 		response(c, gin.H{"ok": false, "msg": err.Error()})
 		return
 	}
 
-	response(c, gin.H{"ok": true, "list": list})
+	info["ok"] = true
+	response(c, info)
+}
+
+// groupInfo returns the alive servers and the effective settings of the group
+func groupInfo(group string) (gin.H, error) {
+	list, err := service.GetAllAliveServerAddresses(group)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := service.GetGroupConfig(group)
+	if err != nil {
+		return nil, err
+	}
+
+	weights, err := service.GetAllWeights(group)
+	if err != nil {
+		return nil, err
+	}
+
+	connections, err := service.GetAllConnections(group)
+	if err != nil {
+		return nil, err
+	}
+
+	health, err := service.GetAllHealth(group)
+	if err != nil {
+		return nil, err
+	}
+
+	outliers, err := service.GetAllOutliers(group)
+	if err != nil {
+		return nil, err
+	}
+
+	pools, err := service.GetAllPools(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{"group": group, "list": list, "weights": weights, "connections": connections, "health": health, "outliers": outliers, "pools": pools, "settings": conf}, nil
 }
 
 // OpenGroup group-open.do?group=<监听端口> 打开端口监听
 func OpenGroup(c *gin.Context) {
 	tcpPort := c.Query("group")
-	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%s", tcpPort))
+	if tcpPort == "" {
+		response(c, gin.H{"ok": false, "msg": "group is required"})
+		return
+	}
+
+	err := service.OpenGroup(tcpPort)
 	if err != nil {
 		response(c, gin.H{"ok": false, "msg": err.Error()})
 		return
 	}
-	lis.Close()
 
-	go service.StartService(tcpPort)
 	response(c, gin.H{"ok": true})
 }
 
-// CloseGroup group-close.do?group=<监听端口> 关闭端口监听
+// CloseGroup group-close.do?group=<监听端口> 关闭端口监听, the running sessions are drained in the background
 func CloseGroup(c *gin.Context) {
 	tcpPort := c.Query("group")
-	err := service.SendStopListenPackage(tcpPort)
+	err := service.CloseGroup(tcpPort)
 	if err != nil {
 		response(c, gin.H{"ok": false, "msg": err.Error()})
 		return
 	}
 
-	response(c, gin.H{"ok": true})
+	status, _ := service.GetDrainStatus(tcpPort)
+	response(c, gin.H{"ok": true, "draining": status})
+}
+
+// SetACL acl-set.do?group=<监听端口>&allow=<CIDR>,<CIDR>&deny=<CIDR>,<CIDR> 设置分组的acl, 没有给出的列表为空
+func SetACL(c *gin.Context) {
+	tcpPort := c.Query("group")
+	acl := config.ACLConfig{Allow: splitList(c.Query("allow")), Deny: splitList(c.Query("deny"))}
+	err := service.SetACL(tcpPort, acl)
+	if err != nil {
+		response(c, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+
+	response(c, gin.H{"ok": true, "acl": acl})
+}
+
+// splitList returns the comma separated values without the empty ones
+func splitList(value string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
 }
 
 func response(c *gin.Context, result interface{}) {
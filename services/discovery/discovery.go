@@ -14,22 +14,45 @@ type Service struct {
 	// deadLastSeen  map[string]*timestamp     // H
 	aliveLastSeen   map[string]time.Time // V
 	remoteAddresses map[string]struct{}  // All known remote service addresses
+	staticAddresses map[string]struct{}  // Configured remote addresses, they never expire
+	weights         map[string]int       // Weights given by the worker registrations
+	health          map[string]*healthState
+	outliers        map[string]*outlierState
+
+	healthCheck      config.HealthCheckConfig
+	healthReset      chan struct{} // wakes up the health check after its config changes
+	probeDialer      ProbeDialer
+	outlierDetection config.OutlierDetectionConfig
 
 	lock     sync.RWMutex
 	conf     config.ProxyConfig
 	stopChan chan struct{}
+	onChange func()               // called after a remote address is learned or expired
+	onExpire func(address string) // called after a remote address registered by heartbeats expired
 }
 
-// NewServiceDiscovery returns a new discovery service
-func NewServiceDiscovery(stopChan chan struct{}) *Service {
+// NewServiceDiscovery returns a new discovery service, the static addresses are always alive
+func NewServiceDiscovery(stopChan chan struct{}, staticAddresses ...string) *Service {
 	disc := &Service{
 		aliveLastSeen:   make(map[string]time.Time),
 		remoteAddresses: make(map[string]struct{}),
+		staticAddresses: make(map[string]struct{}),
+		weights:         make(map[string]int),
+		health:          make(map[string]*healthState),
+		healthReset:     make(chan struct{}, 1),
+		probeDialer:     dialProbe,
+		outliers:        make(map[string]*outlierState),
 		conf:            config.GetConfig(),
 		stopChan:        stopChan,
 	}
 
+	for _, address := range staticAddresses {
+		disc.remoteAddresses[address] = struct{}{}
+		disc.staticAddresses[address] = struct{}{}
+	}
+
 	go disc.periodicalCheckAlive()
+	go disc.periodicalHealthCheck()
 	return disc
 }
 
@@ -37,8 +60,14 @@ func NewServiceDiscovery(stopChan chan struct{}) *Service {
 func (disc *Service) HandleAliveMessage(remoteAddress string) {
 	disc.lock.RLock()
 	_, known := disc.remoteAddresses[remoteAddress]
+	_, static := disc.staticAddresses[remoteAddress]
 	disc.lock.RUnlock()
 
+	// The static addresses don't need any heartbeat
+	if static {
+		return
+	}
+
 	if !known {
 		disc.learnNewRemoteAddress(remoteAddress)
 		return
@@ -59,14 +88,81 @@ func (disc *Service) HandleAliveMessage(remoteAddress string) {
 	}
 }
 
-func (disc *Service) learnNewRemoteAddress(remoteAddress string) {
+// SetWeight records the weight given by the worker registration, zero or a negative weight means the default weight
+func (disc *Service) SetWeight(remoteAddress string, weight int) {
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	if weight <= 0 {
+		delete(disc.weights, remoteAddress)
+		return
+	}
+	disc.weights[remoteAddress] = weight
+}
+
+// Weight returns the weight given by the worker registration, zero when the worker gives none
+func (disc *Service) Weight(remoteAddress string) int {
+	disc.lock.RLock()
+	defer disc.lock.RUnlock()
+
+	return disc.weights[remoteAddress]
+}
+
+// SetStaticAddresses replaces the static addresses, an address that also sends heartbeats stays alive
+func (disc *Service) SetStaticAddresses(staticAddresses []string) {
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	for address := range disc.staticAddresses {
+		if _, registered := disc.aliveLastSeen[address]; !registered {
+			delete(disc.remoteAddresses, address)
+			delete(disc.health, address)
+			delete(disc.outliers, address)
+		}
+	}
+
+	disc.staticAddresses = make(map[string]struct{})
+	for _, address := range staticAddresses {
+		disc.remoteAddresses[address] = struct{}{}
+		disc.staticAddresses[address] = struct{}{}
+	}
+}
+
+// OnChange registers a callback which is called after a remote address is learned or expired
+func (disc *Service) OnChange(onChange func()) {
 	disc.lock.Lock()
 	defer disc.lock.Unlock()
 
+	disc.onChange = onChange
+}
+
+// OnExpire registers a callback which is called for every expired remote address, the static addresses
+// are never expired
+func (disc *Service) OnExpire(onExpire func(address string)) {
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	disc.onExpire = onExpire
+}
+
+func (disc *Service) notifyChange() {
+	disc.lock.RLock()
+	onChange := disc.onChange
+	disc.lock.RUnlock()
+
+	if onChange != nil {
+		onChange()
+	}
+}
+
+func (disc *Service) learnNewRemoteAddress(remoteAddress string) {
+	disc.lock.Lock()
 	disc.remoteAddresses[remoteAddress] = struct{}{}
 	disc.aliveLastSeen[remoteAddress] = time.Now()
-
 	log.Printf("Learning a new remote address: %s, lastSeen: %s", remoteAddress, disc.aliveLastSeen[remoteAddress])
+	disc.lock.Unlock()
+
+	disc.notifyChange()
 }
 
 func (disc *Service) learnExistedRemoteAddress(remoteAddress string, now time.Time) {
@@ -78,14 +174,18 @@ func (disc *Service) learnExistedRemoteAddress(remoteAddress string, now time.Ti
 	log.Printf("Learning a existed remote address: %s, lastSeen: %s", remoteAddress, disc.aliveLastSeen[remoteAddress])
 }
 
-// GetAllAliveRemoteAddresses 获取所有在线服务器列表
+// GetAllAliveRemoteAddresses 获取所有在线服务器列表, the addresses failing the active health check
+// and the ejected addresses are excluded
 func (disc *Service) GetAllAliveRemoteAddresses() []string {
 	disc.lock.RLock()
 	defer disc.lock.RUnlock()
 
+	now := time.Now()
 	addresses := make([]string, 0)
 	for address := range disc.remoteAddresses {
-		addresses = append(addresses, address)
+		if disc.isHealthy(address) && disc.isSelectable(address, now) {
+			addresses = append(addresses, address)
+		}
 	}
 
 	// Sort addresses in ascending order to ensure that the order of each acquisition is consistent
@@ -94,6 +194,54 @@ func (disc *Service) GetAllAliveRemoteAddresses() []string {
 	return addresses
 }
 
+// GetAllRegisteredRemoteAddresses 获取所有通过心跳注册的在线服务器列表, the static addresses are excluded
+func (disc *Service) GetAllRegisteredRemoteAddresses() []string {
+	disc.lock.RLock()
+	defer disc.lock.RUnlock()
+
+	addresses := make([]string, 0)
+	for address := range disc.aliveLastSeen {
+		addresses = append(addresses, address)
+	}
+
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Inherit takes over the addresses registered by heartbeats to another discovery with their last heartbeat
+// and their weights, a newer heartbeat already received is kept
+func (disc *Service) Inherit(from *Service) {
+	from.lock.RLock()
+	lastSeen := make(map[string]time.Time, len(from.aliveLastSeen))
+	weights := make(map[string]int, len(from.weights))
+	for address, ts := range from.aliveLastSeen {
+		lastSeen[address] = ts
+		if weight, ok := from.weights[address]; ok {
+			weights[address] = weight
+		}
+	}
+	from.lock.RUnlock()
+
+	if len(lastSeen) == 0 {
+		return
+	}
+
+	disc.lock.Lock()
+	for address, ts := range lastSeen {
+		if current, ok := disc.aliveLastSeen[address]; ok && current.After(ts) {
+			continue
+		}
+		disc.remoteAddresses[address] = struct{}{}
+		disc.aliveLastSeen[address] = ts
+		if weight, ok := weights[address]; ok {
+			disc.weights[address] = weight
+		}
+	}
+	disc.lock.Unlock()
+
+	disc.notifyChange()
+}
+
 func (disc *Service) periodicalCheckAlive() {
 	log.Println("Starting discovery periodical check alive")
 
@@ -105,21 +253,53 @@ func (disc *Service) periodicalCheckAlive() {
 			return
 		case <-ticker.C:
 			now := time.Now()
+			expired := make([]string, 0)
+			disc.lock.RLock()
 			for address, lastSeen := range disc.aliveLastSeen {
 				if lastSeen.Add(disc.conf.HeartbeatKeepAlive).Before(now) {
-					disc.expireDeadAddress(address, now)
+					expired = append(expired, address)
+				}
+			}
+			disc.lock.RUnlock()
+
+			for _, address := range expired {
+				if disc.expireDeadAddress(address, now) {
+					disc.notifyExpire(address)
 				}
 			}
+			if len(expired) > 0 {
+				disc.notifyChange()
+			}
 		}
 	}
 }
 
-func (disc *Service) expireDeadAddress(remoteAddress string, now time.Time) {
+// expireDeadAddress forgets the heartbeat of the remote address, it reports whether the address was removed
+func (disc *Service) expireDeadAddress(remoteAddress string, now time.Time) bool {
 	disc.lock.Lock()
 	defer disc.lock.Unlock()
 
-	delete(disc.remoteAddresses, remoteAddress)
+	if _, static := disc.staticAddresses[remoteAddress]; !static {
+		delete(disc.remoteAddresses, remoteAddress)
+	}
 	delete(disc.aliveLastSeen, remoteAddress)
+	delete(disc.weights, remoteAddress)
+	if _, static := disc.staticAddresses[remoteAddress]; !static {
+		delete(disc.health, remoteAddress)
+		delete(disc.outliers, remoteAddress)
+	}
 
 	log.Printf("Expired a dead remote address: %s ,at time: %s\n", remoteAddress, now)
+	_, static := disc.staticAddresses[remoteAddress]
+	return !static
+}
+
+func (disc *Service) notifyExpire(address string) {
+	disc.lock.RLock()
+	onExpire := disc.onExpire
+	disc.lock.RUnlock()
+
+	if onExpire != nil {
+		onExpire(address)
+	}
 }
@@ -39,3 +39,87 @@ func Test_ServiceDiscovery(t *testing.T) {
 	_, known2 = disc.remoteAddresses[remoteAddress]
 	assert.False(t, known2)
 }
+
+func Test_OnChange(t *testing.T) {
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	disc := NewServiceDiscovery(stopChan, "127.0.0.1:11112")
+
+	changed := make(chan struct{}, 10)
+	disc.OnChange(func() { changed <- struct{}{} })
+	expired := make(chan string, 10)
+	disc.OnExpire(func(address string) { expired <- address })
+
+	// only a new remote address is a change
+	disc.HandleAliveMessage("127.0.0.1:11110")
+	disc.HandleAliveMessage("127.0.0.1:11110")
+	assert.Equal(t, 1, len(changed))
+	assert.Equal(t, []string{"127.0.0.1:11110"}, disc.GetAllRegisteredRemoteAddresses())
+
+	// expiring is a change as well
+	time.Sleep(disc.conf.HeartbeatKeepAlive + disc.conf.AliveCheckInterval)
+	assert.Equal(t, 2, len(changed))
+	assert.Empty(t, disc.GetAllRegisteredRemoteAddresses())
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, "127.0.0.1:11110", <-expired)
+}
+
+func Test_StaticAddresses(t *testing.T) {
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	disc := NewServiceDiscovery(stopChan, "127.0.0.1:11112", "127.0.0.1:11111")
+
+	assert.Equal(t, []string{"127.0.0.1:11111", "127.0.0.1:11112"}, disc.GetAllAliveRemoteAddresses())
+
+	// a heartbeat of a static address changes nothing
+	disc.HandleAliveMessage("127.0.0.1:11111")
+	assert.Equal(t, 0, len(disc.aliveLastSeen))
+
+	// static addresses never expire
+	time.Sleep(disc.conf.HeartbeatKeepAlive + disc.conf.AliveCheckInterval)
+	assert.Equal(t, []string{"127.0.0.1:11111", "127.0.0.1:11112"}, disc.GetAllAliveRemoteAddresses())
+}
+
+func Test_Weight(t *testing.T) {
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	disc := NewServiceDiscovery(stopChan)
+
+	disc.HandleAliveMessage("127.0.0.1:11110")
+	assert.Equal(t, 0, disc.Weight("127.0.0.1:11110"))
+	disc.SetWeight("127.0.0.1:11110", 8)
+	assert.Equal(t, 8, disc.Weight("127.0.0.1:11110"))
+	disc.SetWeight("127.0.0.1:11110", 0)
+	assert.Equal(t, 0, disc.Weight("127.0.0.1:11110"))
+
+	// the weight is forgotten when the worker expires
+	disc.SetWeight("127.0.0.1:11110", 8)
+	time.Sleep(disc.conf.HeartbeatKeepAlive + disc.conf.AliveCheckInterval)
+	assert.Equal(t, 0, disc.Weight("127.0.0.1:11110"))
+}
+
+func Test_SetStaticAddresses(t *testing.T) {
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	disc := NewServiceDiscovery(stopChan, "127.0.0.1:11111", "127.0.0.1:11112")
+	disc.HandleAliveMessage("127.0.0.1:11110")
+
+	disc.SetStaticAddresses([]string{"127.0.0.1:11113"})
+	assert.Equal(t, []string{"127.0.0.1:11110", "127.0.0.1:11113"}, disc.GetAllAliveRemoteAddresses())
+	assert.Equal(t, []string{"127.0.0.1:11110"}, disc.GetAllRegisteredRemoteAddresses())
+}
+
+func Test_Inherit(t *testing.T) {
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	old := NewServiceDiscovery(stopChan, "127.0.0.1:11111")
+	old.HandleAliveMessage("127.0.0.1:11110")
+	old.SetWeight("127.0.0.1:11110", 8)
+
+	// the static addresses come from the new settings
+	disc := NewServiceDiscovery(stopChan, "127.0.0.1:11112")
+	disc.Inherit(old)
+	assert.Equal(t, []string{"127.0.0.1:11110", "127.0.0.1:11112"}, disc.GetAllAliveRemoteAddresses())
+	assert.Equal(t, []string{"127.0.0.1:11110"}, disc.GetAllRegisteredRemoteAddresses())
+	assert.Equal(t, 8, disc.Weight("127.0.0.1:11110"))
+}
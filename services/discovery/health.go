@@ -0,0 +1,235 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+)
+
+// ProbeDialer connects an active probe to the remote address, the probes talk to the connection
+// in plaintext once it is returned
+type ProbeDialer func(address string, timeout time.Duration) (net.Conn, error)
+
+// dialProbe the default ProbeDialer, a plain connection
+func dialProbe(address string, timeout time.Duration) (net.Conn, error) {
+	network, address := config.SplitNetwork("tcp", address)
+	return net.DialTimeout(network, address, timeout)
+}
+
+// healthState the result of the active probes of a remote address
+type healthState struct {
+	healthy   bool
+	successes int // consecutive successes while unhealthy
+	failures  int // consecutive failures while healthy
+}
+
+// SetHealthCheck replaces the active probes of the remote addresses, an empty type disables them
+// and every remote address is selectable again
+func (disc *Service) SetHealthCheck(hc config.HealthCheckConfig) {
+	disc.lock.Lock()
+	disc.healthCheck = hc
+	if hc.Type == "" {
+		disc.health = make(map[string]*healthState)
+	}
+	disc.lock.Unlock()
+
+	select {
+	case disc.healthReset <- struct{}{}:
+	default:
+	}
+}
+
+// SetProbeDialer replaces how the active probes connect, for the remote addresses which expect the
+// same PROXY header or TLS as the sessions
+func (disc *Service) SetProbeDialer(dialer ProbeDialer) {
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	disc.probeDialer = dialer
+}
+
+// GetHealth returns whether every known remote address passes the active probes
+func (disc *Service) GetHealth() map[string]bool {
+	disc.lock.RLock()
+	defer disc.lock.RUnlock()
+
+	health := make(map[string]bool, len(disc.remoteAddresses))
+	for address := range disc.remoteAddresses {
+		health[address] = disc.isHealthy(address)
+	}
+	return health
+}
+
+// isHealthy must be called with the lock held, an address which is not probed yet is healthy
+func (disc *Service) isHealthy(address string) bool {
+	state, ok := disc.health[address]
+	return !ok || state.healthy
+}
+
+// periodicalHealthCheck runs alongside periodicalCheckAlive and probes every known remote address
+func (disc *Service) periodicalHealthCheck() {
+	for {
+		disc.lock.RLock()
+		hc := disc.healthCheck
+		disc.lock.RUnlock()
+
+		var tick <-chan time.Time
+		if hc.Type != "" {
+			tick = time.After(hc.Interval)
+		}
+
+		select {
+		case <-disc.stopChan:
+			return
+		case <-disc.healthReset:
+		case <-tick:
+			disc.checkHealth(hc)
+		}
+	}
+}
+
+// checkHealth probes all the remote addresses concurrently and applies the rise and fall thresholds
+func (disc *Service) checkHealth(hc config.HealthCheckConfig) {
+	disc.lock.RLock()
+	addresses := make([]string, 0, len(disc.remoteAddresses))
+	for address := range disc.remoteAddresses {
+		addresses = append(addresses, address)
+	}
+	dial := disc.probeDialer
+	disc.lock.RUnlock()
+
+	results := make(map[string]error, len(addresses))
+	var resultsLock sync.Mutex
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+
+			err := probe(hc, dial, address)
+			resultsLock.Lock()
+			results[address] = err
+			resultsLock.Unlock()
+		}(address)
+	}
+	wg.Wait()
+
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	for address, err := range results {
+		if _, known := disc.remoteAddresses[address]; !known {
+			continue
+		}
+
+		state, ok := disc.health[address]
+		if !ok {
+			state = &healthState{healthy: true}
+			disc.health[address] = state
+		}
+
+		switch {
+		case err == nil && state.healthy:
+			state.failures = 0
+		case err == nil:
+			if state.successes++; state.successes >= hc.Rise {
+				state.healthy, state.successes = true, 0
+				log.Printf("Health check passed, the remote address %s re-enters the selectable set\n", address)
+			}
+		case state.healthy:
+			if state.failures++; state.failures >= hc.Fall {
+				state.healthy, state.failures = false, 0
+				log.Printf("Health check failed, the remote address %s leaves the selectable set, error: %s\n", address, err)
+			}
+		default:
+			state.successes = 0
+		}
+	}
+}
+
+// probe runs one active probe against the remote address
+func probe(hc config.HealthCheckConfig, dial ProbeDialer, address string) error {
+	switch hc.Type {
+	case config.HEALTHCHECKHTTP:
+		return probeHTTP(dial, address, hc.Path, hc.Timeout)
+	case config.HEALTHCHECKSEND:
+		return probeSend(dial, address, []byte(hc.Send), []byte(hc.Expect), hc.Timeout)
+	default:
+		return probeTCP(dial, address, hc.Timeout)
+	}
+}
+
+func probeTCP(dial ProbeDialer, address string, timeout time.Duration) error {
+	conn, err := dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeSend(dial ProbeDialer, address string, send, expect []byte, timeout time.Duration) error {
+	conn, err := dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write(send); err != nil {
+		return err
+	}
+	if len(expect) == 0 {
+		return nil
+	}
+
+	response := make([]byte, len(expect))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if !bytes.Equal(response, expect) {
+		return fmt.Errorf("unexpected response %q", response)
+	}
+	return nil
+}
+
+func probeHTTP(dial ProbeDialer, address, path string, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout: timeout,
+		// A redirect is a healthy answer by itself
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		// Every probe gets a new connection from the dialer, which does the TLS of the backends if any
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return dial(address, timeout)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	// A unix domain socket gets the requests for localhost
+	host := address
+	if config.IsUnix(address) {
+		host = "localhost"
+	}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s%s", host, path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
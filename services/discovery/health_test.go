@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func healthCheckForTests(checkType string) config.HealthCheckConfig {
+	return config.HealthCheckConfig{Type: checkType, Interval: 50 * time.Millisecond, Timeout: 100 * time.Millisecond, Rise: 2, Fall: 2, Path: "/health"}
+}
+
+func Test_TCPHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	disc := NewServiceDiscovery(stopChan, address, "127.0.0.1:1")
+	disc.SetHealthCheck(healthCheckForTests(config.HEALTHCHECKTCP))
+
+	// the closed port falls out of the selectable set
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []string{address}, disc.GetAllAliveRemoteAddresses())
+	assert.Equal(t, map[string]bool{address: true, "127.0.0.1:1": false}, disc.GetHealth())
+
+	listener.Close()
+	time.Sleep(300 * time.Millisecond)
+	assert.Empty(t, disc.GetAllAliveRemoteAddresses())
+
+	// reopening the port lets it rise again
+	listener, err = net.Listen("tcp", address)
+	assert.NoError(t, err)
+	defer listener.Close()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []string{address}, disc.GetAllAliveRemoteAddresses())
+
+	// disabling the check makes every address selectable
+	disc.SetHealthCheck(config.HealthCheckConfig{})
+	assert.Equal(t, 2, len(disc.GetAllAliveRemoteAddresses()))
+}
+
+func Test_HTTPHealthCheck(t *testing.T) {
+	var status int32 = http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	disc := NewServiceDiscovery(stopChan, address)
+	disc.SetHealthCheck(healthCheckForTests(config.HEALTHCHECKHTTP))
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Empty(t, disc.GetAllAliveRemoteAddresses())
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []string{address}, disc.GetAllAliveRemoteAddresses())
+}
+
+func Test_SendHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					conn.Write([]byte("PONG"))
+				}
+			}()
+		}
+	}()
+	address := listener.Addr().String()
+
+	hc := healthCheckForTests(config.HEALTHCHECKSEND)
+	hc.Send, hc.Expect = "PING", "PONG"
+	assert.NoError(t, probe(hc, dialProbe, address))
+
+	hc.Expect = "OK"
+	assert.Error(t, probe(hc, dialProbe, address))
+}
+
+func Test_UnixProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "health.sock"))
+	assert.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	address := config.UNIXPREFIX + filepath.Join(dir, "health.sock")
+	assert.NoError(t, probe(healthCheckForTests(config.HEALTHCHECKTCP), dialProbe, address))
+	assert.NoError(t, probe(healthCheckForTests(config.HEALTHCHECKHTTP), dialProbe, address))
+	assert.Error(t, probe(healthCheckForTests(config.HEALTHCHECKTCP), dialProbe, config.UNIXPREFIX+filepath.Join(dir, "missing.sock")))
+}
@@ -0,0 +1,181 @@
+package discovery
+
+import (
+	"log"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+)
+
+// The states of the circuit breaker of a remote address
+const (
+	OUTLIERCLOSED   = "closed"    // selectable
+	OUTLIEREJECTED  = "ejected"   // not selectable until the ejection time is over
+	OUTLIERHALFOPEN = "half-open" // admits a few trial connections which decide to close or eject again
+)
+
+// OutlierStatus the circuit breaker of a remote address, reported by worker-list.do
+type OutlierStatus struct {
+	State        string    `json:"state"`
+	Failures     int       `json:"failures"`  // consecutive failures while closed
+	Ejections    int       `json:"ejections"` // ejections in a row, the ejection time doubles with each
+	EjectedUntil time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// outlierState the passive failure counting of a remote address
+type outlierState struct {
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+	trials       int // trial connections in flight while half-open
+}
+
+func (state *outlierState) status(now time.Time) string {
+	switch {
+	case state.ejections == 0:
+		return OUTLIERCLOSED
+	case now.Before(state.ejectedUntil):
+		return OUTLIEREJECTED
+	default:
+		return OUTLIERHALFOPEN
+	}
+}
+
+// SetOutlierDetection replaces the settings of the passive outlier detection,
+// disabling it closes every circuit breaker
+func (disc *Service) SetOutlierDetection(od config.OutlierDetectionConfig) {
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	disc.outlierDetection = od
+	if !od.Enabled() {
+		disc.outliers = make(map[string]*outlierState)
+	}
+}
+
+// isSelectable must be called with the lock held
+func (disc *Service) isSelectable(address string, now time.Time) bool {
+	state, ok := disc.outliers[address]
+	if !ok {
+		return true
+	}
+
+	switch state.status(now) {
+	case OUTLIEREJECTED:
+		return false
+	case OUTLIERHALFOPEN:
+		return state.trials < disc.outlierDetection.HalfOpenTrials
+	}
+	return true
+}
+
+// Admit is called before connecting to the picked remote address, it refuses an ejected address and
+// a half-open address whose trial connections are all in flight. A trial connection must report its result
+func (disc *Service) Admit(address string) (trial bool, ok bool) {
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	state, known := disc.outliers[address]
+	if !known {
+		return false, true
+	}
+
+	switch state.status(time.Now()) {
+	case OUTLIEREJECTED:
+		return false, false
+	case OUTLIERHALFOPEN:
+		if state.trials >= disc.outlierDetection.HalfOpenTrials {
+			return false, false
+		}
+		state.trials++
+		return true, true
+	}
+	return false, true
+}
+
+// ReportResult counts the result of a connection to the remote address, err is the dial or io failure
+func (disc *Service) ReportResult(address string, trial bool, err error) {
+	disc.lock.Lock()
+	defer disc.lock.Unlock()
+
+	od := disc.outlierDetection
+	if !od.Enabled() {
+		return
+	}
+	if _, known := disc.remoteAddresses[address]; !known {
+		return
+	}
+
+	state, ok := disc.outliers[address]
+	if !ok {
+		if err == nil {
+			return
+		}
+		state = &outlierState{}
+		disc.outliers[address] = state
+	}
+
+	now := time.Now()
+	if trial {
+		if state.trials > 0 {
+			state.trials--
+		}
+		if err == nil {
+			log.Printf("Trial connection succeeded, the remote address %s is closed again\n", address)
+			delete(disc.outliers, address)
+			return
+		}
+		disc.eject(address, state, now, err)
+		return
+	}
+
+	// The results of the connections started before an ejection do not count
+	if state.status(now) != OUTLIERCLOSED {
+		return
+	}
+	if err == nil {
+		delete(disc.outliers, address)
+		return
+	}
+	if state.failures++; state.failures >= od.ConsecutiveFailures {
+		disc.eject(address, state, now, err)
+	}
+}
+
+// eject must be called with the lock held
+func (disc *Service) eject(address string, state *outlierState, now time.Time, err error) {
+	od := disc.outlierDetection
+
+	ejectionTime := od.BaseEjectionTime
+	for i := 0; i < state.ejections && ejectionTime < od.MaxEjectionTime; i++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > od.MaxEjectionTime {
+		ejectionTime = od.MaxEjectionTime
+	}
+
+	state.failures = 0
+	state.ejections++
+	state.ejectedUntil = now.Add(ejectionTime)
+	log.Printf("Ejected the remote address %s for %s, ejections: %d, error: %s\n", address, ejectionTime, state.ejections, err)
+}
+
+// GetOutliers returns the circuit breaker of every known remote address
+func (disc *Service) GetOutliers() map[string]OutlierStatus {
+	disc.lock.RLock()
+	defer disc.lock.RUnlock()
+
+	now := time.Now()
+	outliers := make(map[string]OutlierStatus, len(disc.remoteAddresses))
+	for address := range disc.remoteAddresses {
+		status := OutlierStatus{State: OUTLIERCLOSED}
+		if state, ok := disc.outliers[address]; ok {
+			status = OutlierStatus{State: state.status(now), Failures: state.failures, Ejections: state.ejections}
+			if status.State != OUTLIERCLOSED {
+				status.EjectedUntil = state.ejectedUntil
+			}
+		}
+		outliers[address] = status
+	}
+	return outliers
+}
@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OutlierDetection(t *testing.T) {
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	address := "127.0.0.1:11113"
+	disc := NewServiceDiscovery(stopChan, address)
+	disc.SetOutlierDetection(config.OutlierDetectionConfig{ConsecutiveFailures: 3, BaseEjectionTime: 100 * time.Millisecond, MaxEjectionTime: 300 * time.Millisecond, HalfOpenTrials: 1})
+	failure := errors.New("connection refused")
+
+	// a success in between resets the consecutive failures
+	disc.ReportResult(address, false, failure)
+	disc.ReportResult(address, false, failure)
+	disc.ReportResult(address, false, nil)
+	disc.ReportResult(address, false, failure)
+	disc.ReportResult(address, false, failure)
+	assert.Equal(t, []string{address}, disc.GetAllAliveRemoteAddresses())
+	assert.Equal(t, OutlierStatus{State: OUTLIERCLOSED, Failures: 2}, disc.GetOutliers()[address])
+
+	disc.ReportResult(address, false, failure)
+	assert.Empty(t, disc.GetAllAliveRemoteAddresses())
+	assert.Equal(t, OUTLIEREJECTED, disc.GetOutliers()[address].State)
+	_, ok := disc.Admit(address)
+	assert.False(t, ok)
+
+	// half-open admits a single trial, whose failure doubles the ejection time
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, OUTLIERHALFOPEN, disc.GetOutliers()[address].State)
+	trial, ok := disc.Admit(address)
+	assert.True(t, trial)
+	assert.True(t, ok)
+	assert.Empty(t, disc.GetAllAliveRemoteAddresses())
+	_, ok = disc.Admit(address)
+	assert.False(t, ok)
+
+	now := time.Now()
+	disc.ReportResult(address, true, failure)
+	status := disc.GetOutliers()[address]
+	assert.Equal(t, 2, status.Ejections)
+	assert.WithinDuration(t, now.Add(200*time.Millisecond), status.EjectedUntil, 50*time.Millisecond)
+
+	// a successful trial closes the circuit breaker
+	time.Sleep(250 * time.Millisecond)
+	trial, ok = disc.Admit(address)
+	assert.True(t, trial && ok)
+	disc.ReportResult(address, true, nil)
+	assert.Equal(t, OutlierStatus{State: OUTLIERCLOSED}, disc.GetOutliers()[address])
+	assert.Equal(t, []string{address}, disc.GetAllAliveRemoteAddresses())
+
+	// disabling it admits everything
+	disc.SetOutlierDetection(config.OutlierDetectionConfig{ConsecutiveFailures: -1})
+	for i := 0; i < 5; i++ {
+		disc.ReportResult(address, false, failure)
+	}
+	assert.Equal(t, []string{address}, disc.GetAllAliveRemoteAddresses())
+}
@@ -0,0 +1,82 @@
+package lb
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VIRTUALNODES the number of points each remote address owns on the ring
+const VIRTUALNODES = 160
+
+// ConsistentHash 一致性哈希(ketama)，根据客户端地址在哈希环上顺时针找到第一台服务器，
+// 服务器上线或下线时只有约1/N的客户端会被重新分配
+type ConsistentHash struct {
+	ring *hashRing // the ring of the last remote addresses
+	lock sync.Mutex
+}
+
+// GetAddress implements IBalancePolicy
+func (ch *ConsistentHash) GetAddress(localAddress string, remoteAddresses []string) string {
+	if len(remoteAddresses) == 0 {
+		return ""
+	}
+
+	ch.lock.Lock()
+	key := strings.Join(remoteAddresses, ",")
+	if ch.ring == nil || ch.ring.key != key {
+		ch.ring = newHashRing(key, remoteAddresses)
+	}
+	ring := ch.ring
+	ch.lock.Unlock()
+
+	return ring.get(localAddress)
+}
+
+type hashRing struct {
+	key       string // the remote addresses the ring is built from
+	points    []uint32
+	addresses map[uint32]string
+}
+
+func newHashRing(key string, remoteAddresses []string) *hashRing {
+	ring := &hashRing{
+		key:       key,
+		points:    make([]uint32, 0, len(remoteAddresses)*VIRTUALNODES),
+		addresses: make(map[uint32]string, len(remoteAddresses)*VIRTUALNODES),
+	}
+
+	// Every md5 digest gives 4 points, the same as ketama
+	for _, address := range remoteAddresses {
+		for i := 0; i < VIRTUALNODES/4; i++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", address, i)))
+			for j := 0; j < 4; j++ {
+				point := binary.LittleEndian.Uint32(digest[j*4:])
+				if _, ok := ring.addresses[point]; ok {
+					continue
+				}
+
+				ring.addresses[point] = address
+				ring.points = append(ring.points, point)
+			}
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// get returns the first remote address clockwise from the hash of the key
+func (ring *hashRing) get(key string) string {
+	digest := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(digest[:])
+
+	index := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if index == len(ring.points) {
+		index = 0
+	}
+	return ring.addresses[ring.points[index]]
+}
@@ -0,0 +1,88 @@
+package lb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ConsistentHash(t *testing.T) {
+	ch := ConsistentHash{}
+	address := ch.GetAddress("127.0.0.1", remoteAddressesForTests)
+	for index := 0; index < 10; index++ {
+		assert.Equal(t, address, ch.GetAddress("127.0.0.1", remoteAddressesForTests))
+	}
+
+	assert.Equal(t, "", ch.GetAddress("127.0.0.1", nil))
+}
+
+func Test_ConsistentHashDistribution(t *testing.T) {
+	servers, keys := serversForTests(10), keysForTests(10000)
+	ch := ConsistentHash{}
+
+	counts := make(map[string]int)
+	for _, key := range keys {
+		counts[ch.GetAddress(key, servers)]++
+	}
+
+	// every server gets its share within 25% of the mean
+	mean := len(keys) / len(servers)
+	assert.Equal(t, len(servers), len(counts))
+	for server, count := range counts {
+		assert.InDelta(t, mean, count, float64(mean)/4, server)
+	}
+}
+
+func Test_ConsistentHashMinimalDisruption(t *testing.T) {
+	servers, keys := serversForTests(10), keysForTests(10000)
+	ch := ConsistentHash{}
+
+	before := make(map[string]string)
+	for _, key := range keys {
+		before[key] = ch.GetAddress(key, servers)
+	}
+
+	// a server leaves: only its own keys move
+	left := servers[3]
+	remaining := append(append([]string{}, servers[:3]...), servers[4:]...)
+	moved := 0
+	for _, key := range keys {
+		after := ch.GetAddress(key, remaining)
+		if before[key] != left {
+			assert.Equal(t, before[key], after)
+		}
+		if after != before[key] {
+			moved++
+		}
+	}
+	assert.InDelta(t, len(keys)/len(servers), moved, float64(len(keys)/len(servers))/4)
+
+	// a server joins: only the keys it takes over move, about 1/N of them
+	joined := append(append([]string{}, servers...), "10.0.0.100:80")
+	moved = 0
+	for _, key := range keys {
+		after := ch.GetAddress(key, joined)
+		if after != before[key] {
+			assert.Equal(t, "10.0.0.100:80", after)
+			moved++
+		}
+	}
+	assert.InDelta(t, len(keys)/len(joined), moved, float64(len(keys)/len(joined))/4)
+}
+
+func serversForTests(n int) []string {
+	servers := make([]string, 0, n)
+	for index := 0; index < n; index++ {
+		servers = append(servers, fmt.Sprintf("10.0.0.%d:80", index+1))
+	}
+	return servers
+}
+
+func keysForTests(n int) []string {
+	keys := make([]string, 0, n)
+	for index := 0; index < n; index++ {
+		keys = append(keys, fmt.Sprintf("192.168.%d.%d", index/256, index%256))
+	}
+	return keys
+}
@@ -0,0 +1,122 @@
+package lb
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The parameters of the EWMA policy, it adapts without any configuration
+const (
+	EWMAALPHA = 0.3              // weight of a new sample
+	EWMADECAY = 10 * time.Second // an unobserved score decays to zero so that a recovered backend gets picked again
+)
+
+// IFeedbackPolicy is implemented by the policies which learn from the measured latencies
+type IFeedbackPolicy interface {
+	// ObserveConnect records how long dialing the remote address took, a failed dial counts as the dial timeout
+	ObserveConnect(address string, latency time.Duration)
+	// ObserveFirstByte records how long the remote address took to send the first byte of a session
+	ObserveFirstByte(address string, latency time.Duration)
+}
+
+// EWMA 延迟感知，记录每台服务器连接时间和首字节时间的指数加权移动平均值，
+// 随机抽取两台服务器(power of two choices)，转发到负载较低的一台
+type EWMA struct {
+	info   IBackendInfo
+	scores map[string]*ewmaScore
+	random *rand.Rand
+	lock   sync.Mutex
+}
+
+type ewmaScore struct {
+	connect   float64 // nanoseconds
+	firstByte float64 // nanoseconds
+	updated   time.Time
+}
+
+// NewEWMA returns an EWMA policy, info may be nil when the live session counts are unknown
+func NewEWMA(info IBackendInfo) *EWMA {
+	return &EWMA{
+		info:   info,
+		scores: make(map[string]*ewmaScore),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// GetAddress implements IBalancePolicy
+func (e *EWMA) GetAddress(localAddress string, remoteAddresses []string) string {
+	switch len(remoteAddresses) {
+	case 0:
+		return ""
+	case 1:
+		return remoteAddresses[0]
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	i := e.random.Intn(len(remoteAddresses))
+	j := e.random.Intn(len(remoteAddresses) - 1)
+	if j >= i {
+		j++
+	}
+
+	first, second := remoteAddresses[i], remoteAddresses[j]
+	if e.cost(second) < e.cost(first) {
+		return second
+	}
+	return first
+}
+
+// ObserveConnect implements IFeedbackPolicy
+func (e *EWMA) ObserveConnect(address string, latency time.Duration) {
+	e.observe(address, func(score *ewmaScore) *float64 { return &score.connect }, latency)
+}
+
+// ObserveFirstByte implements IFeedbackPolicy
+func (e *EWMA) ObserveFirstByte(address string, latency time.Duration) {
+	e.observe(address, func(score *ewmaScore) *float64 { return &score.firstByte }, latency)
+}
+
+func (e *EWMA) observe(address string, field func(*ewmaScore) *float64, latency time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	score, ok := e.scores[address]
+	if !ok {
+		score = &ewmaScore{}
+		e.scores[address] = score
+	}
+
+	e.decay(score)
+	value := field(score)
+	if *value == 0 {
+		*value = float64(latency)
+	} else {
+		*value = EWMAALPHA*float64(latency) + (1-EWMAALPHA)*(*value)
+	}
+}
+
+// decay lets the score fade since its last update, it must be called with the lock held
+func (e *EWMA) decay(score *ewmaScore) {
+	now := time.Now()
+	if !score.updated.IsZero() {
+		factor := math.Exp(-float64(now.Sub(score.updated)) / float64(EWMADECAY))
+		score.connect *= factor
+		score.firstByte *= factor
+	}
+	score.updated = now
+}
+
+// cost is the latency score weighted by the in-flight sessions, it must be called with the lock held
+func (e *EWMA) cost(address string) float64 {
+	latency := 0.0
+	if score, ok := e.scores[address]; ok {
+		e.decay(score)
+		latency = score.connect + score.firstByte
+	}
+
+	return (latency + 1) * float64(connectionsOf(e.info, address)+1)
+}
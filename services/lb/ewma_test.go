@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EWMA(t *testing.T) {
+	addresses := []string{"fast", "slow", "medium"}
+	e := NewEWMA(nil)
+	for index := 0; index < 5; index++ {
+		e.ObserveConnect("fast", time.Millisecond)
+		e.ObserveFirstByte("fast", time.Millisecond)
+		e.ObserveConnect("medium", 10*time.Millisecond)
+		e.ObserveFirstByte("medium", 10*time.Millisecond)
+		e.ObserveConnect("slow", 500*time.Millisecond)
+		e.ObserveFirstByte("slow", time.Second)
+	}
+
+	// the slow backend loses every comparison, the fast one wins every comparison it is part of
+	counts := make(map[string]int)
+	for index := 0; index < 3000; index++ {
+		counts[e.GetAddress("", addresses)]++
+	}
+	assert.Equal(t, 0, counts["slow"])
+	assert.InDelta(t, 2000, counts["fast"], 200)
+	assert.InDelta(t, 1000, counts["medium"], 200)
+
+	assert.Equal(t, "", e.GetAddress("", nil))
+	assert.Equal(t, "slow", e.GetAddress("", []string{"slow"}))
+}
+
+func Test_EWMAAverage(t *testing.T) {
+	e := NewEWMA(nil)
+	e.ObserveConnect("a", 100*time.Millisecond)
+	assert.InDelta(t, float64(100*time.Millisecond), e.scores["a"].connect, float64(time.Millisecond))
+
+	e.ObserveConnect("a", 200*time.Millisecond)
+	assert.InDelta(t, float64(130*time.Millisecond), e.scores["a"].connect, float64(time.Millisecond))
+
+	// an old score fades away
+	e.scores["a"].updated = time.Now().Add(-10 * EWMADECAY)
+	assert.True(t, e.cost("a") < float64(10*time.Microsecond))
+}
+
+func Test_EWMAConnections(t *testing.T) {
+	backends := &backendsForTests{connections: map[string]int{"a": 10, "b": 0}}
+	e := NewEWMA(backends)
+	e.ObserveConnect("a", time.Millisecond)
+	e.ObserveConnect("b", 2*time.Millisecond)
+
+	// the busy backend costs more even though it is faster
+	for index := 0; index < 10; index++ {
+		assert.Equal(t, "b", e.GetAddress("", []string{"a", "b"}))
+	}
+}
@@ -9,18 +9,44 @@ type IBalancePolicy interface {
 	GetAddress(localAddress string, remoteAddresses []string) string
 }
 
-// PolicyFactory 使用工厂模式创建实例
+// IBackendInfo provides the runtime information of the remote addresses to the policies which need it
+type IBackendInfo interface {
+	// Weight returns the weight of the remote address
+	Weight(address string) int
+	// Connections returns the live session count of the remote address
+	Connections(address string) int
+}
+
+// PolicyFactory 使用工厂模式创建实例, the policies are fixed once the factory is created
 type PolicyFactory struct {
 	policyMap map[PolicyStatus]IBalancePolicy
 }
 
-// InitFactory initialize the load balance factory
-func InitFactory() *PolicyFactory {
+// FactoryOption customizes the policies of a new factory
+type FactoryOption func(policyMap map[PolicyStatus]IBalancePolicy)
+
+// WithPolicy replaces the built-in policy of the status
+func WithPolicy(status PolicyStatus, policy IBalancePolicy) FactoryOption {
+	return func(policyMap map[PolicyStatus]IBalancePolicy) {
+		policyMap[status] = policy
+	}
+}
+
+// InitFactory initialize the load balance factory, info may be nil when no policy needs it
+func InitFactory(info IBackendInfo, options ...FactoryOption) *PolicyFactory {
 	factory := &PolicyFactory{make(map[PolicyStatus]IBalancePolicy)}
 
 	factory.policyMap[HA] = &Ha{}
 	factory.policyMap[ROUNDROBIN] = &RoundRobin{}
 	factory.policyMap[IPHASH] = &IPHash{}
+	factory.policyMap[WEIGHTEDROUNDROBIN] = &WeightedRoundRobin{info: info}
+	factory.policyMap[LEASTCONNECTIONS] = &LeastConnections{info: info}
+	factory.policyMap[WEIGHTEDLEASTCONNECTIONS] = &WeightedLeastConnections{info: info}
+	factory.policyMap[CONSISTENTHASH] = &ConsistentHash{}
+	factory.policyMap[LATENCYEWMA] = NewEWMA(info)
+	for _, option := range options {
+		option(factory.policyMap)
+	}
 	return factory
 }
 
@@ -45,6 +71,16 @@ func (status PolicyStatus) String() string {
 		return "round-robin"
 	case IPHASH:
 		return "ip_hash"
+	case WEIGHTEDROUNDROBIN:
+		return "weighted-round-robin"
+	case LEASTCONNECTIONS:
+		return "least-conn"
+	case WEIGHTEDLEASTCONNECTIONS:
+		return "weighted-least-conn"
+	case CONSISTENTHASH:
+		return "consistent-hash"
+	case LATENCYEWMA:
+		return "ewma"
 	default:
 		return "unknown"
 	}
@@ -53,11 +89,21 @@ func (status PolicyStatus) String() string {
 // ha - 热备，总是把所有请求转发到在线服务器列表的首台服务器，直至其掉线移除
 // round-robin - 循环，每一次把来自用户的请求轮流分配给所有在线服务器，从1开始，直到N(内部服务器个数)，然后重新开始循环。
 // ip_hash - 根据客户端ip计算hash code，然后取在线服务器数量的模得到N，然后转发到第N台服务器
+// weighted-round-robin - 平滑加权轮询，按服务器注册的权重分配请求
+// least-conn - 最少连接，转发到当前会话数最少的在线服务器
+// weighted-least-conn - 加权最少连接，转发到 会话数/权重 最小的在线服务器
+// consistent-hash - 一致性哈希，服务器上线或下线时只有约1/N的客户端会被重新分配
+// ewma - 延迟感知，随机抽取两台服务器，转发到连接时间和首字节时间的加权平均值较低的一台
 const (
 	UNKNOWN PolicyStatus = iota
 	HA
 	ROUNDROBIN
 	IPHASH
+	WEIGHTEDROUNDROBIN
+	LEASTCONNECTIONS
+	WEIGHTEDLEASTCONNECTIONS
+	CONSISTENTHASH
+	LATENCYEWMA
 )
 
 // PolicyNames for int convert to PolicyStatus
@@ -66,4 +112,9 @@ var PolicyNames = map[int]PolicyStatus{
 	1: HA,
 	2: ROUNDROBIN,
 	3: IPHASH,
+	4: WEIGHTEDROUNDROBIN,
+	5: LEASTCONNECTIONS,
+	6: WEIGHTEDLEASTCONNECTIONS,
+	7: CONSISTENTHASH,
+	8: LATENCYEWMA,
 }
@@ -7,15 +7,15 @@ import (
 )
 
 func Test_PolicyFactory(t *testing.T) {
-	factory := InitFactory()
+	factory := InitFactory(nil)
 
 	for _, policy := range factory.policyMap {
 		address := policy.GetAddress("", remoteAddressesForTests)
 		assert.NotEmpty(t, address)
 	}
 
-	assert.Equal(t, 3, len(factory.policyMap))
-	for index := 1; index <= 3; index++ {
+	assert.Equal(t, len(PolicyNames)-1, len(factory.policyMap))
+	for index := 1; index < len(PolicyNames); index++ {
 		policy, err := factory.GetLBPolicy(PolicyStatus(index))
 		assert.NoError(t, err)
 		address := policy.GetAddress("", remoteAddressesForTests)
@@ -26,4 +26,9 @@ func Test_PolicyFactory(t *testing.T) {
 	policy, err := factory.GetLBPolicy(PolicyStatus(0))
 	assert.Error(t, err)
 	assert.Nil(t, policy)
+
+	factory = InitFactory(nil, WithPolicy(HA, &RoundRobin{}))
+	policy, err = factory.GetLBPolicy(HA)
+	assert.NoError(t, err)
+	assert.IsType(t, &RoundRobin{}, policy)
 }
@@ -0,0 +1,61 @@
+package lb
+
+import (
+	"sync"
+)
+
+// LeastConnections 最少连接，把请求转发到当前会话数最少的在线服务器，会话数相同时轮流分配
+type LeastConnections struct {
+	info  IBackendInfo
+	index int // rotates the start of the scan so that ties are spread
+	lock  sync.Mutex
+}
+
+// GetAddress implements IBalancePolicy
+func (lc *LeastConnections) GetAddress(localAddress string, remoteAddresses []string) string {
+	return leastConnections(lc.info, &lc.index, &lc.lock, remoteAddresses, func(string) int { return 1 })
+}
+
+// WeightedLeastConnections 加权最少连接，把请求转发到 会话数/权重 最小的在线服务器
+type WeightedLeastConnections struct {
+	info  IBackendInfo
+	index int
+	lock  sync.Mutex
+}
+
+// GetAddress implements IBalancePolicy
+func (wlc *WeightedLeastConnections) GetAddress(localAddress string, remoteAddresses []string) string {
+	return leastConnections(wlc.info, &wlc.index, &wlc.lock, remoteAddresses, func(address string) int { return weightOf(wlc.info, address) })
+}
+
+func leastConnections(info IBackendInfo, index *int, lock *sync.Mutex, remoteAddresses []string, weight func(string) int) string {
+	if len(remoteAddresses) == 0 {
+		return ""
+	}
+
+	lock.Lock()
+	start := *index % len(remoteAddresses)
+	*index++
+	lock.Unlock()
+
+	best, bestConns, bestWeight := "", 0, 1
+	for i := range remoteAddresses {
+		address := remoteAddresses[(start+i)%len(remoteAddresses)]
+		conns, w := connectionsOf(info, address), weight(address)
+
+		// conns/w < bestConns/bestWeight without the float division
+		if best == "" || conns*bestWeight < bestConns*w {
+			best, bestConns, bestWeight = address, conns, w
+		}
+	}
+	return best
+}
+
+// connectionsOf returns the live session count of the remote address, it is 0 without any backend information
+func connectionsOf(info IBackendInfo, address string) int {
+	if info == nil {
+		return 0
+	}
+
+	return info.Connections(address)
+}
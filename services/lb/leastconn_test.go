@@ -0,0 +1,61 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type backendsForTests struct {
+	weights     map[string]int
+	connections map[string]int
+}
+
+func (backends *backendsForTests) Weight(address string) int {
+	return backends.weights[address]
+}
+
+func (backends *backendsForTests) Connections(address string) int {
+	return backends.connections[address]
+}
+
+func Test_LeastConnections(t *testing.T) {
+	addresses := []string{"a", "b", "c"}
+	backends := &backendsForTests{connections: map[string]int{"a": 3, "b": 1, "c": 2}}
+	lc := LeastConnections{info: backends}
+	for index := 0; index < 10; index++ {
+		assert.Equal(t, "b", lc.GetAddress("", addresses))
+	}
+
+	// the connections pile up on the least loaded one until they are even
+	counts := make(map[string]int)
+	for index := 0; index < 6; index++ {
+		address := lc.GetAddress("", addresses)
+		backends.connections[address]++
+		counts[address]++
+	}
+	assert.Equal(t, map[string]int{"a": 4, "b": 4, "c": 4}, backends.connections)
+	assert.Equal(t, 1, counts["a"])
+
+	// ties are spread
+	lc = LeastConnections{}
+	for index := 0; index < 10; index++ {
+		assert.Equal(t, addresses[index%len(addresses)], lc.GetAddress("", addresses))
+	}
+
+	assert.Equal(t, "", lc.GetAddress("", nil))
+}
+
+func Test_WeightedLeastConnections(t *testing.T) {
+	addresses := []string{"a", "b"}
+	backends := &backendsForTests{weights: map[string]int{"a": 1, "b": 3}, connections: map[string]int{}}
+	wlc := WeightedLeastConnections{info: backends}
+
+	for index := 0; index < 40; index++ {
+		backends.connections[wlc.GetAddress("", addresses)]++
+	}
+	assert.Equal(t, 10, backends.connections["a"])
+	assert.Equal(t, 30, backends.connections["b"])
+
+	assert.Equal(t, "", wlc.GetAddress("", nil))
+}
@@ -0,0 +1,55 @@
+package lb
+
+import (
+	"sync"
+)
+
+// WeightedRoundRobin 平滑加权轮询(nginx smooth weighted round-robin)，按服务器权重分配请求，且不会把请求连续集中到同一台服务器
+type WeightedRoundRobin struct {
+	info    IBackendInfo
+	current map[string]int // current weight of each remote address
+	lock    sync.Mutex
+}
+
+// GetAddress implements IBalancePolicy
+func (wrr *WeightedRoundRobin) GetAddress(localAddress string, remoteAddresses []string) string {
+	if len(remoteAddresses) == 0 {
+		return ""
+	}
+
+	wrr.lock.Lock()
+	defer wrr.lock.Unlock()
+
+	// Forget the remote addresses which are offline
+	current := make(map[string]int, len(remoteAddresses))
+	for _, address := range remoteAddresses {
+		current[address] = wrr.current[address]
+	}
+	wrr.current = current
+
+	best, total := "", 0
+	for _, address := range remoteAddresses {
+		weight := weightOf(wrr.info, address)
+		wrr.current[address] += weight
+		total += weight
+
+		if best == "" || wrr.current[address] > wrr.current[best] {
+			best = address
+		}
+	}
+
+	wrr.current[best] -= total
+	return best
+}
+
+// weightOf returns the weight of the remote address, it is 1 without any backend information
+func weightOf(info IBackendInfo, address string) int {
+	if info == nil {
+		return 1
+	}
+
+	if weight := info.Weight(address); weight > 0 {
+		return weight
+	}
+	return 1
+}
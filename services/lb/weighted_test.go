@@ -0,0 +1,37 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WeightedRoundRobin(t *testing.T) {
+	addresses := []string{"a", "b", "c"}
+	wrr := WeightedRoundRobin{info: &backendsForTests{weights: map[string]int{"a": 5, "b": 1, "c": 1}}}
+
+	// the nginx smooth sequence for 5:1:1
+	expected := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for round := 0; round < 3; round++ {
+		for _, address := range expected {
+			assert.Equal(t, address, wrr.GetAddress("", addresses))
+		}
+	}
+
+	// spread by weight
+	wrr = WeightedRoundRobin{info: &backendsForTests{weights: map[string]int{"a": 4, "b": 32}}}
+	counts := make(map[string]int)
+	for index := 0; index < 360; index++ {
+		counts[wrr.GetAddress("", []string{"a", "b"})]++
+	}
+	assert.Equal(t, 40, counts["a"])
+	assert.Equal(t, 320, counts["b"])
+
+	// no weights is a plain round-robin
+	wrr = WeightedRoundRobin{}
+	for index := 0; index < 10; index++ {
+		assert.Equal(t, addresses[index%len(addresses)], wrr.GetAddress("", addresses))
+	}
+
+	assert.Equal(t, "", wrr.GetAddress("", nil))
+}
@@ -15,13 +15,17 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/wangff15386/goproxy/config"
 	"github.com/wangff15386/goproxy/services/api"
+	"github.com/wangff15386/goproxy/services/metrics"
 	"github.com/wangff15386/goproxy/services/service"
 )
 
 func main() {
 	conf := config.GetConfig()
 
-	go service.StartService(conf.TCPPort)
+	if err := service.StartAllGroups(conf, config.StatePath()); err != nil {
+		log.Fatalln("Error to restore the state, error:", err)
+	}
+	watchReload()
 	gracefulStartHTTP(conf, setupRouter())
 }
 
@@ -44,9 +48,28 @@ func setupRouter() *gin.Engine {
 	r.POST("group-open.do", api.OpenGroup)
 	// group-close.do?group=<监听端口> 关闭端口监听
 	r.POST("group-close.do", api.CloseGroup)
+	// acl-set.do?group=<监听端口>&allow=<CIDR>,<CIDR>&deny=<CIDR>,<CIDR> 设置分组的acl
+	r.POST("acl-set.do", api.SetACL)
+	// metrics Prometheus格式的监控指标
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
 	return r
 }
 
+// watchReload reloads the config file on SIGHUP and every time the file is written,
+// the httpport and pprofport can only be changed by a restart
+func watchReload() {
+	config.WatchConfig(func() { service.Reload() })
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Receive SIGHUP, reloading config ...")
+			service.Reload()
+		}
+	}()
+}
+
 func gracefulStartHTTP(conf config.ProxyConfig, router *gin.Engine) {
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", conf.HTTPPort),
@@ -69,14 +92,15 @@ func gracefulStartHTTP(conf config.ProxyConfig, router *gin.Engine) {
 
 	// Wait for interrupt signal to gracefully shutdown the server with
 	// a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can"t be catch, so don't need add it
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutdown Server ...")
-	service.SendStopListenPackage(conf.TCPPort)
+	// The admin api keeps serving the drain progress until every group is drained
+	service.StopAllGroups()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
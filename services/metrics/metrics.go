@@ -0,0 +1,387 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The metrics of the proxy, written in the Prometheus text exposition format by Handler
+var (
+	SessionsAccepted = NewCounterVec("goproxy_sessions_accepted_total", "Client sessions accepted.", "group")
+	SessionsClosed   = NewCounterVec("goproxy_sessions_closed_total", "Client sessions closed.", "group")
+	BytesIn          = NewCounterVec("goproxy_bytes_in_total", "Bytes read from the clients and written to the backends.", "group", "backend")
+	BytesOut         = NewCounterVec("goproxy_bytes_out_total", "Bytes read from the backends and written to the clients.", "group", "backend")
+	DialErrors       = NewCounterVec("goproxy_dial_errors_total", "Failed dials to the backends.", "group", "backend")
+	Heartbeats       = NewCounterVec("goproxy_heartbeats_total", "Heartbeats received from the backends.", "group", "backend")
+	SessionsRejected = NewCounterVec("goproxy_sessions_rejected_total", "Client sessions refused by the limits of the group.", "group", "limit")
+	DialDuration     = NewHistogramVec("goproxy_dial_duration_seconds", "Duration of the successful dials to the backends.",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}, "group", "backend")
+	SessionDuration = NewHistogramVec("goproxy_session_duration_seconds", "Duration of the client sessions.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}, "group", "backend")
+)
+
+// collector writes one metric family
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	collectors    = make(map[string]collector)
+	collectorLock sync.RWMutex
+)
+
+func register(c collector) {
+	collectorLock.Lock()
+	defer collectorLock.Unlock()
+
+	if _, ok := collectors[c.name()]; ok {
+		panic(fmt.Sprintf("metric %s is registered more than once", c.name()))
+	}
+	collectors[c.name()] = c
+}
+
+// Handler serves all the registered metrics in the Prometheus text exposition format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write writes all the registered metrics in ascending order of their names
+func Write(w io.Writer) error {
+	collectorLock.RLock()
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]collector, 0, len(names))
+	for _, name := range names {
+		families = append(families, collectors[name])
+	}
+	collectorLock.RUnlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, family := range families {
+		family.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Counter the counter of one combination of the label values, it is safe to add without any lock
+type Counter struct {
+	bits uint64 // math.Float64bits of the value
+}
+
+// Add adds a non-negative value to the counter
+func (c *Counter) Add(value float64) {
+	if value < 0 {
+		return
+	}
+
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		if atomic.CompareAndSwapUint64(&c.bits, old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+// Value returns the counter
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// CounterVec a counter for each combination of the label values
+type CounterVec struct {
+	metricName string
+	help       string
+	labels     []string
+	values     map[string]*Counter
+	lock       sync.Mutex
+}
+
+// NewCounterVec creates and registers a counter family
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{metricName: name, help: help, labels: labels, values: make(map[string]*Counter)}
+	register(counter)
+	return counter
+}
+
+// With returns the counter of the label values for the hot paths to resolve once. A counter kept after
+// its series is deleted is no longer written
+func (counter *CounterVec) With(labelValues ...string) *Counter {
+	key := labelPairs(counter.labels, labelValues)
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	c, ok := counter.values[key]
+	if !ok {
+		c = &Counter{}
+		counter.values[key] = c
+	}
+	return c
+}
+
+// Inc adds one to the counter of the label values
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds a non-negative value to the counter of the label values
+func (counter *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	counter.With(labelValues...).Add(value)
+}
+
+// Value returns the counter of the label values
+func (counter *CounterVec) Value(labelValues ...string) float64 {
+	key := labelPairs(counter.labels, labelValues)
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if c, ok := counter.values[key]; ok {
+		return c.Value()
+	}
+	return 0
+}
+
+// Delete removes the series whose first labels have the label values, fewer values than labels match
+// every value of the remaining labels
+func (counter *CounterVec) Delete(labelValues ...string) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	for key := range counter.values {
+		if matchPairs(counter.labels, labelValues, key) {
+			delete(counter.values, key)
+		}
+	}
+}
+
+func (counter *CounterVec) name() string {
+	return counter.metricName
+}
+
+func (counter *CounterVec) write(w io.Writer) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	writeHeader(w, counter.metricName, counter.help, "counter")
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		writeSample(w, counter.metricName, key, counter.values[key].Value())
+	}
+}
+
+// HistogramVec a histogram for each combination of the label values
+type HistogramVec struct {
+	metricName string
+	help       string
+	labels     []string
+	buckets    []float64 // upper bounds in ascending order, +Inf is implied
+	values     map[string]*histogram
+	lock       sync.Mutex
+}
+
+type histogram struct {
+	counts []uint64 // not cumulative, the last one counts the observations above every bound
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates and registers a histogram family
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+
+	vec := &HistogramVec{metricName: name, help: help, labels: labels, buckets: sorted, values: make(map[string]*histogram)}
+	register(vec)
+	return vec
+}
+
+// Observe adds one observation to the histogram of the label values
+func (vec *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := labelPairs(vec.labels, labelValues)
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	h, ok := vec.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(vec.buckets)+1)}
+		vec.values[key] = h
+	}
+
+	h.counts[sort.SearchFloat64s(vec.buckets, value)]++
+	h.sum += value
+	h.count++
+}
+
+// Count returns the number of the observations of the label values
+func (vec *HistogramVec) Count(labelValues ...string) uint64 {
+	key := labelPairs(vec.labels, labelValues)
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	if h, ok := vec.values[key]; ok {
+		return h.count
+	}
+	return 0
+}
+
+// Delete removes the series whose first labels have the label values, like CounterVec.Delete
+func (vec *HistogramVec) Delete(labelValues ...string) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	for key := range vec.values {
+		if matchPairs(vec.labels, labelValues, key) {
+			delete(vec.values, key)
+		}
+	}
+}
+
+func (vec *HistogramVec) name() string {
+	return vec.metricName
+}
+
+func (vec *HistogramVec) write(w io.Writer) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	writeHeader(w, vec.metricName, vec.help, "histogram")
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := vec.values[key]
+		cumulative := uint64(0)
+		for i, bound := range vec.buckets {
+			cumulative += h.counts[i]
+			writeSample(w, vec.metricName+"_bucket", joinPairs(key, "le", formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, vec.metricName+"_bucket", joinPairs(key, "le", "+Inf"), float64(h.count))
+		writeSample(w, vec.metricName+"_sum", key, h.sum)
+		writeSample(w, vec.metricName+"_count", key, float64(h.count))
+	}
+}
+
+// GaugeFunc a gauge family whose values are collected at every scrape
+type GaugeFunc struct {
+	metricName string
+	help       string
+	labels     []string
+	collect    func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc creates and registers a gauge family, collect emits the value of every combination of the label values
+func NewGaugeFunc(name, help string, collect func(emit func(value float64, labelValues ...string)), labels ...string) *GaugeFunc {
+	gauge := &GaugeFunc{metricName: name, help: help, labels: labels, collect: collect}
+	register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) name() string {
+	return gauge.metricName
+}
+
+func (gauge *GaugeFunc) write(w io.Writer) {
+	values := make(map[string]float64)
+	gauge.collect(func(value float64, labelValues ...string) {
+		values[labelPairs(gauge.labels, labelValues)] = value
+	})
+
+	writeHeader(w, gauge.metricName, gauge.help, "gauge")
+	for _, key := range sortedKeys(values) {
+		writeSample(w, gauge.metricName, key, values[key])
+	}
+}
+
+// labelPairs formats the label pairs as they appear between the braces, a missing value is empty
+func labelPairs(labels, labelValues []string) string {
+	pairs := make([]string, 0, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeLabelValue(value)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// matchPairs reports whether the label pairs of a series start with the label values, the escaped
+// values cannot contain the separator of two pairs
+func matchPairs(labels, labelValues []string, pairs string) bool {
+	if len(labelValues) > len(labels) {
+		return false
+	}
+
+	prefix := labelPairs(labels[:len(labelValues)], labelValues)
+	return prefix == "" || pairs == prefix || strings.HasPrefix(pairs, prefix+",")
+}
+
+func joinPairs(pairs, label, value string) string {
+	pair := fmt.Sprintf(`%s="%s"`, label, value)
+	if pairs == "" {
+		return pair
+	}
+	return pairs + "," + pair
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, pairs string, value float64) {
+	if pairs == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, pairs, formatFloat(value))
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
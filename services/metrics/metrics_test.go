@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeForTests(t *testing.T) string {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func Test_Counter(t *testing.T) {
+	counter := NewCounterVec("test_counter_total", "A counter.", "group", "backend")
+	counter.Inc("a", "127.0.0.1:1")
+	counter.Add(2.5, "a", "127.0.0.1:1")
+	counter.Add(-1, "a", "127.0.0.1:1")
+	counter.Inc("b\"\\\n", "")
+	assert.Equal(t, 3.5, counter.Value("a", "127.0.0.1:1"))
+
+	body := scrapeForTests(t)
+	assert.Contains(t, body, "# HELP test_counter_total A counter.\n# TYPE test_counter_total counter\n"+
+		`test_counter_total{group="a",backend="127.0.0.1:1"} 3.5`+"\n"+
+		`test_counter_total{group="b\"\\\n",backend=""} 1`+"\n")
+
+	// a resolved counter adds to the same series until it is deleted
+	c := counter.With("a", "127.0.0.1:2")
+	c.Add(2)
+	counter.Inc("ab", "127.0.0.1:2")
+	assert.Equal(t, float64(2), counter.Value("a", "127.0.0.1:2"))
+	counter.Delete("a", "127.0.0.1:2")
+	assert.Equal(t, float64(0), counter.Value("a", "127.0.0.1:2"))
+	assert.Equal(t, 3.5, counter.Value("a", "127.0.0.1:1"))
+	counter.Delete("a")
+	assert.Equal(t, float64(0), counter.Value("a", "127.0.0.1:1"))
+	assert.Equal(t, float64(1), counter.Value("ab", "127.0.0.1:2"))
+}
+
+func Test_Histogram(t *testing.T) {
+	histogram := NewHistogramVec("test_duration_seconds", "A histogram.", []float64{1, 0.1}, "group")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.1, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(7, "a")
+	assert.Equal(t, uint64(4), histogram.Count("a"))
+	assert.Equal(t, uint64(0), histogram.Count("b"))
+
+	body := scrapeForTests(t)
+	assert.Contains(t, body, "# TYPE test_duration_seconds histogram\n"+
+		`test_duration_seconds_bucket{group="a",le="0.1"} 2`+"\n"+
+		`test_duration_seconds_bucket{group="a",le="1"} 3`+"\n"+
+		`test_duration_seconds_bucket{group="a",le="+Inf"} 4`+"\n"+
+		`test_duration_seconds_sum{group="a"} 7.65`+"\n"+
+		`test_duration_seconds_count{group="a"} 4`+"\n")
+
+	histogram.Delete("a")
+	assert.Equal(t, uint64(0), histogram.Count("a"))
+}
+
+func Test_GaugeFunc(t *testing.T) {
+	value := 1.0
+	NewGaugeFunc("test_gauge", "A gauge.", func(emit func(value float64, labelValues ...string)) {
+		emit(value, "a")
+	}, "group")
+
+	assert.Contains(t, scrapeForTests(t), "# TYPE test_gauge gauge\ntest_gauge{group=\"a\"} 1\n")
+	value = 3
+	assert.Contains(t, scrapeForTests(t), "test_gauge{group=\"a\"} 3\n")
+
+	assert.Panics(t, func() { NewCounterVec("test_gauge", "Registered twice.") })
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wangff15386/goproxy/services/lb"
+)
+
+// The termination reasons of a session in the access log
+const (
+	REASONCLIENTEOF    = "client_eof"    // the client closed the connection
+	REASONBACKENDEOF   = "backend_eof"   // the backend closed the connection
+	REASONTIMEOUT      = "timeout"       // both sides idle for RWTimeout
+	REASONADMINKILL    = "admin_kill"    // force closed by the drain of the group
+	REASONDIALERROR    = "dial_error"    // no backend could be connected
+	REASONCLIENTERROR  = "client_error"  // io failure of the client connection
+	REASONBACKENDERROR = "backend_error" // io failure of the backend connection
+	REASONPROXYERROR   = "proxy_error"   // the PROXY header required by the group is missing or broken
+	REASONTLSERROR     = "tls_error"     // the TLS handshake with the client failed
+)
+
+// accessRecord one JSON line written when a session closes
+type accessRecord struct {
+	ID       string    `json:"id"`
+	Group    string    `json:"group"`
+	Client   string    `json:"client"`
+	Backend  string    `json:"backend"`
+	Pool     string    `json:"pool,omitempty"` // the pool picked by the routes, omitted for the default pool
+	LBPolicy string    `json:"lbpolicy"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // seconds
+	BytesIn  int64     `json:"bytesIn"`  // from the client to the backend
+	BytesOut int64     `json:"bytesOut"` // from the backend to the client
+	Reason   string    `json:"reason"`
+}
+
+// The destination of the access log, stdout unless a file is configured
+var (
+	accessLog     io.Writer = os.Stdout
+	accessLogFile *os.File
+	accessLogPath string
+	accessLogLock sync.Mutex
+)
+
+// SetAccessLog directs the access log to the file appended to, an empty path is stdout
+func SetAccessLog(path string) error {
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+
+	if path == accessLogPath {
+		return nil
+	}
+
+	var writer io.Writer = os.Stdout
+	var file *os.File
+	if path != "" {
+		var err error
+		if file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			return errors.WithMessage(err, "Error to open the access log")
+		}
+		writer = file
+	}
+
+	if accessLogFile != nil {
+		accessLogFile.Close()
+	}
+	accessLog, accessLogFile, accessLogPath = writer, file, path
+	log.Printf("Writing the access log to: %s\n", path)
+	return nil
+}
+
+func writeAccessLog(record accessRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Error to marshal the access log, error:", err)
+		return
+	}
+
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+	if _, err = accessLog.Write(append(line, '\n')); err != nil {
+		log.Println("Error to write the access log, error:", err)
+	}
+}
+
+// newSessionID returns a random id to find a session across the logs
+func newSessionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
+
+// logAccess writes the access log of the finished session
+func (service *TCPProxySessionService) logAccess(clientProxySession *TCPProxySession) {
+	reason := clientProxySession.reason
+	if atomic.LoadInt32(&clientProxySession.killed) == 1 {
+		reason = REASONADMINKILL
+	}
+
+	writeAccessLog(accessRecord{
+		ID:       clientProxySession.id,
+		Group:    clientProxySession.conf.Name,
+		Client:   clientProxySession.clientAddr().String(),
+		Backend:  clientProxySession.address,
+		Pool:     clientProxySession.pool,
+		LBPolicy: lb.PolicyNames[clientProxySession.conf.LBPolicy].String(),
+		Start:    clientProxySession.accepted,
+		Duration: time.Since(clientProxySession.accepted).Seconds(),
+		BytesIn:  atomic.LoadInt64(&clientProxySession.bytesIn),
+		BytesOut: atomic.LoadInt64(&clientProxySession.bytesOut),
+		Reason:   reason,
+	})
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+func readAccessLogForTests(t *testing.T, path, group string) []accessRecord {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	records := make([]accessRecord, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record accessRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		if record.Group == group {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func Test_AccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	assert.NoError(t, SetAccessLog(path))
+	defer SetAccessLog("")
+
+	remoteAddress := "127.0.0.1:11136"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11115")
+	groupConf.Name = "accesslog-tests"
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.DrainTimeout = 100 * time.Millisecond
+	assert.NoError(t, StartService(groupConf))
+	time.Sleep(200 * time.Millisecond)
+
+	// the client closes the first session, the drain kills the second one
+	clientConn, err := net.Dial("tcp", "localhost:11115")
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "ping")
+	client := clientConn.LocalAddr().String()
+	start := time.Now()
+	clientConn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	clientConn, err = net.Dial("tcp", "localhost:11115")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	echoForTests(t, clientConn, "hello")
+	assert.NoError(t, stopListenForTests(groupConf.Name))
+	time.Sleep(100 * time.Millisecond)
+
+	records := readAccessLogForTests(t, path, groupConf.Name)
+	assert.Equal(t, 2, len(records))
+	assert.NotEqual(t, records[0].ID, records[1].ID)
+
+	record := records[0]
+	assert.Equal(t, client, record.Client)
+	assert.Equal(t, remoteAddress, record.Backend)
+	assert.Equal(t, "ha", record.LBPolicy)
+	assert.WithinDuration(t, start, record.Start, time.Second)
+	assert.True(t, record.Duration > 0)
+	assert.Equal(t, int64(4), record.BytesIn)
+	assert.Equal(t, int64(4), record.BytesOut)
+	assert.Equal(t, REASONCLIENTEOF, record.Reason)
+
+	assert.Equal(t, int64(5), records[1].BytesIn)
+	assert.Equal(t, REASONADMINKILL, records[1].Reason)
+}
+
+func Test_PipeErrorReason(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	clientConn.SetReadDeadline(time.Now())
+	_, timeout := clientConn.Read(make([]byte, 1))
+
+	assert.Equal(t, REASONBACKENDEOF, (&pipeError{conn: serverConn, err: io.EOF}).reason(serverConn))
+	assert.Equal(t, REASONCLIENTEOF, (&pipeError{conn: clientConn, err: io.EOF}).reason(serverConn))
+	assert.Equal(t, REASONTIMEOUT, (&pipeError{conn: clientConn, err: timeout}).reason(serverConn))
+	assert.Equal(t, REASONBACKENDERROR, (&pipeError{conn: serverConn, err: io.ErrClosedPipe}).reason(serverConn))
+	assert.Equal(t, REASONCLIENTERROR, (&pipeError{conn: clientConn, err: io.ErrClosedPipe}).reason(serverConn))
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+)
+
+// allowed checks the client address against the acl of the group. The clients of a unix socket have no ip
+// and are always allowed
+func (service *TCPProxySessionService) allowed(addr net.Addr, conf config.GroupConfig) bool {
+	if !conf.ACL.Enabled() {
+		return true
+	}
+
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+
+	// The zone of a link local address is not part of the ip
+	host := ipKey(addr)
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	ok, rule := conf.ACL.Check(net.ParseIP(host))
+	if !ok {
+		service.denyLog.printf(conf.Name, addr, rule)
+	}
+	return ok
+}
+
+// ACLDENYLOGINTERVAL the denials of a group are counted per acl rule and logged once per interval
+const ACLDENYLOGINTERVAL = time.Second
+
+// denyLog aggregates the deny lines of a group, a flood of denied clients or of the datagrams of a
+// denied udp client logs one line per rule and interval
+type denyLog struct {
+	lock    sync.Mutex
+	denials map[string]*denial // by acl rule, nil until the first denial of the interval
+}
+
+// denial the denials of one acl rule in the interval and the first denied client as a sample
+type denial struct {
+	count  int
+	client net.Addr
+}
+
+func (l *denyLog) printf(group string, addr net.Addr, rule string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.denials == nil {
+		l.denials = make(map[string]*denial)
+		time.AfterFunc(ACLDENYLOGINTERVAL, func() { l.flush(group) })
+	}
+	d, ok := l.denials[rule]
+	if !ok {
+		d = &denial{client: addr}
+		l.denials[rule] = d
+	}
+	d.count++
+}
+
+// flush logs the denials of the interval, one line per acl rule
+func (l *denyLog) flush(group string) {
+	l.lock.Lock()
+	denials := l.denials
+	l.denials = nil
+	l.lock.Unlock()
+
+	rules := make([]string, 0, len(denials))
+	for rule := range denials {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		log.Printf("Error to accept client connection, group: %s, denied by acl rule: %s, denials: %d, clientAddr: %s\n",
+			group, rule, denials[rule].count, denials[rule].client)
+	}
+}
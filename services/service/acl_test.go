@@ -0,0 +1,177 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+func Test_ACL(t *testing.T) {
+	go startEchoRemoteForTests("127.0.0.1:11159", make(chan struct{}, 100))
+
+	groupConf := config.GetConfig().NewGroupConfig("11160")
+	groupConf.Servers = []string{"127.0.0.1:11159"}
+	groupConf.ACL = config.ACLConfig{Deny: []string{"127.0.0.0/8"}}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// a denied client never gets a session
+	conn, err := net.Dial("tcp", "127.0.0.1:11160")
+	assert.NoError(t, err)
+	refusedForTests(t, conn)
+	conn.Close()
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	service.lock.RLock()
+	assert.Empty(t, service.proxySessions)
+	service.lock.RUnlock()
+
+	// the acl set through the http api applies to the new connections and is persisted
+	defer func() {
+		stateLock.Lock()
+		delete(state.ACLs, groupConf.Name)
+		stateLock.Unlock()
+	}()
+	acl := config.ACLConfig{Allow: []string{"127.0.0.1"}}
+	assert.NoError(t, SetACL(groupConf.Name, acl))
+	conn, err = net.Dial("tcp", "127.0.0.1:11160")
+	assert.NoError(t, err)
+	echoForTests(t, conn, "allowed")
+	conn.Close()
+
+	stateLock.Lock()
+	assert.Equal(t, acl, state.ACLs[groupConf.Name])
+	assert.Equal(t, acl, withStateACL(config.GroupConfig{Name: groupConf.Name}, state).ACL)
+	stateLock.Unlock()
+	assert.Error(t, SetACL(groupConf.Name, config.ACLConfig{Deny: []string{"127.0.0.1/33"}}))
+
+	// the source address of the PROXY header is checked instead of the load balancer
+	groupConf = config.GetConfig().NewGroupConfig("11161")
+	groupConf.Servers = []string{"127.0.0.1:11159"}
+	groupConf.AcceptProxy = config.PROXYV1
+	groupConf.ACL = config.ACLConfig{Allow: []string{"10.0.0.0/8"}}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err = net.Dial("tcp", "127.0.0.1:11161")
+	assert.NoError(t, err)
+	conn.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 4000 80\r\n"))
+	echoForTests(t, conn, "proxied")
+	conn.Close()
+
+	conn, err = net.Dial("tcp", "127.0.0.1:11161")
+	assert.NoError(t, err)
+	conn.Write([]byte("PROXY TCP4 192.168.1.1 10.0.0.1 4000 80\r\n"))
+	refusedForTests(t, conn)
+	conn.Close()
+}
+
+func Test_UDPACL(t *testing.T) {
+	startUDPRemoteForTests(t, "127.0.0.1:11173", "a")
+
+	groupConf := config.GetConfig().NewGroupConfig("11174")
+	groupConf.Type = config.GROUPUDP
+	groupConf.Servers = []string{"127.0.0.1:11173"}
+	groupConf.ACL = config.ACLConfig{Deny: []string{"127.0.0.0/8"}}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+
+	// the datagrams of a denied client never start a flow, the deny lines are aggregated
+	conn, err := net.Dial("udp", "localhost:11174")
+	assert.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		_, err = conn.Write([]byte("denied"))
+		assert.NoError(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	listener := service.listenr.(*udpListener)
+	listener.lock.Lock()
+	assert.Empty(t, listener.flows)
+	listener.lock.Unlock()
+	service.denyLog.lock.Lock()
+	assert.Len(t, service.denyLog.denials, 1)
+	for _, d := range service.denyLog.denials {
+		assert.Equal(t, 5, d.count)
+	}
+	service.denyLog.lock.Unlock()
+
+	// a client allowed afterwards gets its flow
+	assert.NoError(t, SetACL(groupConf.Name, config.ACLConfig{}))
+	defer func() {
+		stateLock.Lock()
+		delete(state.ACLs, groupConf.Name)
+		stateLock.Unlock()
+	}()
+	assert.Equal(t, "a:allowed", exchangeForTests(t, conn, "allowed"))
+}
+
+func Test_ACLReload(t *testing.T) {
+	stateLock.Lock()
+	state = config.State{}
+	stateLock.Unlock()
+	conf := config.GetConfig()
+	others := make([]config.GroupConfig, 0)
+	for _, group := range GetAllGroups() {
+		groupConf, err := GetGroupConfig(group)
+		assert.NoError(t, err)
+		others = append(others, groupConf)
+	}
+
+	configured := config.ACLConfig{Deny: []string{"10.0.0.0/8"}}
+	conf.Groups = append([]config.GroupConfig{{Name: "acl-reload", Listen: "11175", ACL: configured}}, others...)
+	ApplyConfig(conf)
+	defer stopListenForTests("acl-reload")
+
+	// the acl set through the http api is in force until the config is reloaded
+	assert.NoError(t, SetACL("acl-reload", config.ACLConfig{Allow: []string{"127.0.0.1"}}))
+	groupConf, err := GetGroupConfig("acl-reload")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, groupConf.ACL.Allow)
+
+	// a reload leaving the configured acl untouched keeps the one of the api
+	ApplyConfig(conf)
+	groupConf, err = GetGroupConfig("acl-reload")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, groupConf.ACL.Allow)
+	stateLock.Lock()
+	assert.Contains(t, state.ACLs, "acl-reload")
+	stateLock.Unlock()
+
+	configured = config.ACLConfig{Deny: []string{"10.0.0.0/8", "192.168.0.0/16"}}
+	conf.Groups[0].ACL = configured
+	ApplyConfig(conf)
+	groupConf, err = GetGroupConfig("acl-reload")
+	assert.NoError(t, err)
+	assert.Equal(t, configured, groupConf.ACL)
+	stateLock.Lock()
+	assert.NotContains(t, state.ACLs, "acl-reload")
+	stateLock.Unlock()
+}
+
+func Test_DenyLog(t *testing.T) {
+	var l denyLog
+	first := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}
+	l.printf("deny-log", first, "10.0.0.0/8")
+	l.printf("deny-log", &net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 4000}, "10.0.0.0/8")
+	l.printf("deny-log", &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 4000}, "192.168.0.0/16")
+
+	// every rule is counted apart with its first client
+	l.lock.Lock()
+	assert.Equal(t, &denial{count: 2, client: first}, l.denials["10.0.0.0/8"])
+	assert.Equal(t, 1, l.denials["192.168.0.0/16"].count)
+	l.lock.Unlock()
+
+	time.Sleep(ACLDENYLOGINTERVAL + 100*time.Millisecond)
+	l.lock.Lock()
+	assert.Nil(t, l.denials)
+	l.lock.Unlock()
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+)
+
+// TLS record and handshake constants used to read the ClientHello
+const (
+	tlsRecordHeaderLength     = 5
+	tlsRecordTypeHandshake    = 0x16
+	tlsHandshakeClientHello   = 0x01
+	tlsExtensionServerName    = 0x0000
+	tlsExtensionALPN          = 0x0010
+	tlsServerNameTypeHostname = 0x00
+)
+
+// clientHello the routing information of a TLS ClientHello
+type clientHello struct {
+	serverName string
+	protocols  []string // ALPN
+}
+
+// peekClientHello parses the TLS ClientHello at the start of the stream without consuming it,
+// it returns nil when the stream doesn't start with a TLS handshake
+func peekClientHello(reader *bufio.Reader) (*clientHello, error) {
+	data, err := reader.Peek(1)
+	if err != nil || data[0] != tlsRecordTypeHandshake {
+		return nil, nil
+	}
+
+	header, err := reader.Peek(tlsRecordHeaderLength)
+	if err != nil {
+		return nil, fmt.Errorf("Error to read TLS record header, error: %s", err)
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	record, err := reader.Peek(tlsRecordHeaderLength + length)
+	if err != nil {
+		return nil, fmt.Errorf("Error to read TLS record, error: %s", err)
+	}
+
+	return parseClientHello(record[tlsRecordHeaderLength:])
+}
+
+// parseClientHello parses the handshake message, only the first record is looked at
+func parseClientHello(data []byte) (*clientHello, error) {
+	reader := &byteReader{data: data}
+	if messageType := reader.uint8(); messageType != tlsHandshakeClientHello {
+		return nil, fmt.Errorf("Error to parse ClientHello, unexpected handshake type %d", messageType)
+	}
+
+	message := reader.bytes(int(reader.uint24()))
+	reader = &byteReader{data: message}
+	reader.skip(2 + 32)               // client version and random
+	reader.skip(int(reader.uint8()))  // session id
+	reader.skip(int(reader.uint16())) // cipher suites
+	reader.skip(int(reader.uint8()))  // compression methods
+
+	// A ClientHello without extensions has no server name
+	if reader.err != nil || reader.empty() {
+		return &clientHello{}, reader.err
+	}
+
+	hello := &clientHello{}
+	extensions := &byteReader{data: reader.bytes(int(reader.uint16()))}
+	for !extensions.empty() && extensions.err == nil {
+		extensionType := extensions.uint16()
+		extension := &byteReader{data: extensions.bytes(int(extensions.uint16()))}
+
+		switch extensionType {
+		case tlsExtensionServerName:
+			names := &byteReader{data: extension.bytes(int(extension.uint16()))}
+			for !names.empty() && names.err == nil {
+				nameType := names.uint8()
+				name := names.bytes(int(names.uint16()))
+				if nameType == tlsServerNameTypeHostname {
+					hello.serverName = string(name)
+				}
+			}
+			if names.err != nil {
+				return nil, names.err
+			}
+		case tlsExtensionALPN:
+			protocols := &byteReader{data: extension.bytes(int(extension.uint16()))}
+			for !protocols.empty() && protocols.err == nil {
+				hello.protocols = append(hello.protocols, string(protocols.bytes(int(protocols.uint8()))))
+			}
+			if protocols.err != nil {
+				return nil, protocols.err
+			}
+		}
+	}
+
+	return hello, extensions.err
+}
+
+// byteReader reads the big endian fields of a TLS message, the first short read sets err
+type byteReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *byteReader) empty() bool {
+	return len(reader.data) == 0
+}
+
+func (reader *byteReader) bytes(n int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if n > len(reader.data) {
+		reader.err = fmt.Errorf("Error to parse ClientHello, truncated message")
+		return nil
+	}
+
+	data := reader.data[:n]
+	reader.data = reader.data[n:]
+	return data
+}
+
+func (reader *byteReader) skip(n int) {
+	reader.bytes(n)
+}
+
+func (reader *byteReader) uint8() uint8 {
+	if data := reader.bytes(1); data != nil {
+		return data[0]
+	}
+	return 0
+}
+
+func (reader *byteReader) uint16() uint16 {
+	if data := reader.bytes(2); data != nil {
+		return binary.BigEndian.Uint16(data)
+	}
+	return 0
+}
+
+func (reader *byteReader) uint24() uint32 {
+	if data := reader.bytes(3); data != nil {
+		return uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2])
+	}
+	return 0
+}
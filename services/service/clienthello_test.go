@@ -0,0 +1,51 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PeekClientHello(t *testing.T) {
+	reader := clientHelloForTests(&tls.Config{ServerName: "api.example.com", NextProtos: []string{"h2", "http/1.1"}})
+
+	hello, err := peekClientHello(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "api.example.com", hello.serverName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, hello.protocols)
+
+	// nothing is consumed
+	data, err := reader.Peek(1)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(tlsRecordTypeHandshake), data[0])
+
+	// an ip address is never sent as a server name
+	hello, err = peekClientHello(clientHelloForTests(&tls.Config{ServerName: "127.0.0.1"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "", hello.serverName)
+}
+
+func Test_PeekClientHelloNone(t *testing.T) {
+	hello, err := peekClientHello(bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n")))
+	assert.NoError(t, err)
+	assert.Nil(t, hello)
+
+	_, err = peekClientHello(bufio.NewReader(bytes.NewBuffer([]byte{tlsRecordTypeHandshake, 3, 1, 0, 4, 1, 0, 0, 9})))
+	assert.Error(t, err)
+}
+
+// clientHelloForTests returns a reader holding the ClientHello sent by a real TLS client
+func clientHelloForTests(conf *tls.Config) *bufio.Reader {
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, conf).Handshake()
+	}()
+
+	reader := bufio.NewReaderSize(server, PEEKBUFFERSIZE)
+	reader.Peek(tlsRecordHeaderLength)
+	return reader
+}
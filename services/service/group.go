@@ -0,0 +1,326 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/discovery"
+	"github.com/wangff15386/goproxy/services/metrics"
+)
+
+// The in-process group registry, the admin api reaches a group through it
+// so the proxied port only ever forwards opaque bytes
+var (
+	groups    = make(map[string]*TCPProxySessionService)
+	draining  = make(map[string]*TCPProxySessionService) // closed groups whose sessions are not finished yet
+	groupLock sync.RWMutex
+	drains    sync.WaitGroup
+)
+
+func register(group string, service *TCPProxySessionService) error {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+
+	if _, ok := groups[group]; ok {
+		return fmt.Errorf("Error to register group, group %s is already opened", group)
+	}
+
+	groups[group] = service
+	return nil
+}
+
+func getGroup(group string) (*TCPProxySessionService, error) {
+	groupLock.RLock()
+	defer groupLock.RUnlock()
+
+	service, ok := groups[group]
+	if !ok {
+		return nil, fmt.Errorf("Error to find group, group %s is not opened", group)
+	}
+
+	return service, nil
+}
+
+// unregister removes the group from the registry, only the first caller gets the service back
+func unregister(group string) (*TCPProxySessionService, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+
+	service, ok := groups[group]
+	if !ok {
+		return nil, fmt.Errorf("Error to find group, group %s is not opened", group)
+	}
+
+	delete(groups, group)
+	return service, nil
+}
+
+// WEIGHTRESET given to KeepAlive puts the worker back to the default weight of the group
+const WEIGHTRESET = -1
+
+// KeepAlive 接收服务器注册和心跳 更新在线服务器列表, an empty pool is the default pool of the group and
+// a zero weight keeps the weight the worker registered before, the default weight of the group at first
+func KeepAlive(group, pool, remoteAddress string, weight int) error {
+	if weight < 0 && weight != WEIGHTRESET {
+		return fmt.Errorf("Error to keep alive server %s, weight must not be negative, got %d", remoteAddress, weight)
+	}
+
+	service, err := getGroup(group)
+	if err != nil {
+		return err
+	}
+	if conf := service.getConf(); conf.Type == config.GROUPUDP && config.IsUnix(remoteAddress) {
+		return fmt.Errorf("Error to keep alive server %s, udp group %s has no unix socket", remoteAddress, group)
+	}
+	backendPool, ok := service.getPool(pool)
+	if !ok {
+		return fmt.Errorf("Error to keep alive server %s, group %s has no pool %q", remoteAddress, group, pool)
+	}
+
+	if weight != 0 {
+		backendPool.disc.SetWeight(remoteAddress, weight)
+	}
+	backendPool.disc.HandleAliveMessage(remoteAddress)
+	metrics.Heartbeats.Inc(group, remoteAddress)
+	return nil
+}
+
+// GetAllWeights returns the weight of every alive server of the group
+func GetAllWeights(group string) (map[string]int, error) {
+	service, err := getGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	weights := make(map[string]int)
+	for _, address := range service.disc.GetAllAliveRemoteAddresses() {
+		weights[address] = service.Weight(address)
+	}
+	return weights, nil
+}
+
+// GetAllAliveServerAddresses 查看在线服务器列表
+func GetAllAliveServerAddresses(group string) ([]string, error) {
+	service, err := getGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.disc.GetAllAliveRemoteAddresses(), nil
+}
+
+// GetAllConnections returns the live session count of every alive server of the group
+func GetAllConnections(group string) (map[string]int, error) {
+	service, err := getGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	connections := make(map[string]int)
+	for _, address := range service.disc.GetAllAliveRemoteAddresses() {
+		connections[address] = service.Connections(address)
+	}
+	return connections, nil
+}
+
+// GetAllHealth returns whether every known server of the group passes the active health check
+func GetAllHealth(group string) (map[string]bool, error) {
+	service, err := getGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.disc.GetHealth(), nil
+}
+
+// GetAllOutliers returns the circuit breaker of every known server of the group
+func GetAllOutliers(group string) (map[string]discovery.OutlierStatus, error) {
+	service, err := getGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.disc.GetOutliers(), nil
+}
+
+// GetAllPools returns the alive servers of every named pool of the group
+func GetAllPools(group string) (map[string][]string, error) {
+	service, err := getGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make(map[string][]string)
+	for _, pool := range service.getPools() {
+		if pool.name != "" {
+			pools[pool.name] = pool.disc.GetAllAliveRemoteAddresses()
+		}
+	}
+	return pools, nil
+}
+
+// SetACL replaces the acl of the group, it is checked by the new connections and persisted to the state file
+func SetACL(group string, acl config.ACLConfig) error {
+	if err := acl.Validate(); err != nil {
+		return fmt.Errorf("Error to set acl of group %s, %s", group, err)
+	}
+
+	// A reload at the same time must not apply the acl before
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	service, err := getGroup(group)
+	if err != nil {
+		return err
+	}
+
+	groupConf := service.getConf()
+	groupConf.ACL = acl
+	service.reconfigure(groupConf)
+	persistACL(group, acl)
+	return nil
+}
+
+// GetGroupConfig returns the effective settings of the group
+func GetGroupConfig(group string) (config.GroupConfig, error) {
+	service, err := getGroup(group)
+	if err != nil {
+		return config.GroupConfig{}, err
+	}
+
+	return service.getConf(), nil
+}
+
+// GetAllGroups returns the names of all the opened groups in ascending order
+func GetAllGroups() []string {
+	groupLock.RLock()
+	defer groupLock.RUnlock()
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StopAllGroups drains every group at the same time, including the ones already closing
+func StopAllGroups() {
+	for _, group := range GetAllGroups() {
+		if service, err := stopAccepting(group); err == nil {
+			go drain(group, service)
+		}
+	}
+	drains.Wait()
+}
+
+// stopAccepting removes the group from the registry and closes its listener, the caller must drain it
+func stopAccepting(group string) (*TCPProxySessionService, error) {
+	service, err := unregister(group)
+	if err != nil {
+		return nil, err
+	}
+
+	groupLock.Lock()
+	draining[group] = service
+	groupLock.Unlock()
+	drains.Add(1)
+
+	service.stopAccepting()
+	return service, nil
+}
+
+// restartService moves the group to the listener of the new settings. The new listener is bound before
+// the old one stops accepting, the old group keeps running when it can not be bound
+func restartService(groupConf config.GroupConfig) error {
+	old, err := getGroup(groupConf.Name)
+	if err != nil {
+		return err
+	}
+
+	service, err := prepareService(groupConf, old.lbOptions...)
+	if err != nil {
+		return err
+	}
+
+	groupLock.Lock()
+	if groups[groupConf.Name] != old {
+		groupLock.Unlock()
+		service.abort()
+		return fmt.Errorf("Error to restart group, group %s is closed meanwhile", groupConf.Name)
+	}
+	groups[groupConf.Name] = service
+	draining[groupConf.Name] = old
+	groupLock.Unlock()
+	drains.Add(1)
+
+	// The workers registered by heartbeats stay in their pools, the configured ones come from the new settings
+	for _, pool := range service.getPools() {
+		if oldPool, ok := old.getPool(pool.name); ok {
+			pool.disc.Inherit(oldPool.disc)
+		}
+	}
+
+	old.stopAccepting()
+	go drain(groupConf.Name, old)
+	service.activate()
+	return nil
+}
+
+func drain(group string, service *TCPProxySessionService) {
+	defer drains.Done()
+	service.drain()
+
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	// The group may be opened and closed again meanwhile, the series of a group opened again are kept
+	if draining[group] == service {
+		delete(draining, group)
+		if _, ok := groups[group]; !ok {
+			forgetGroupMetrics(group)
+		}
+	}
+}
+
+// GetDrainStatus returns the progress of a closing group
+func GetDrainStatus(group string) (DrainStatus, bool) {
+	groupLock.RLock()
+	service, ok := draining[group]
+	groupLock.RUnlock()
+
+	if !ok {
+		return DrainStatus{}, false
+	}
+	return service.drainStatus(), true
+}
+
+// GetAllDrainStatus returns the progress of every closing group
+func GetAllDrainStatus() map[string]DrainStatus {
+	groupLock.RLock()
+	services := make(map[string]*TCPProxySessionService, len(draining))
+	for group, service := range draining {
+		services[group] = service
+	}
+	groupLock.RUnlock()
+
+	statuses := make(map[string]DrainStatus, len(services))
+	for group, service := range services {
+		statuses[group] = service.drainStatus()
+	}
+	return statuses
+}
+
+// CloseGroup 关闭端口监听, the closing is persisted to the state file. It returns once the listener is closed,
+// the sessions are drained in the background
+func CloseGroup(group string) error {
+	service, err := stopAccepting(group)
+	if err != nil {
+		return err
+	}
+
+	persistClosed(group)
+	go drain(group, service)
+	return nil
+}
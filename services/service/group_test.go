@@ -0,0 +1,206 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/lb"
+)
+
+func Test_KeepAlive(t *testing.T) {
+	tcpPort := "9999"
+	assert.NoError(t, OpenGroup(tcpPort))
+	defer stopListenForTests(tcpPort)
+
+	remoteAddress := "127.0.0.1:11120"
+	go startRemoteForTests(remoteAddress)
+
+	err := KeepAlive(tcpPort, "", remoteAddress, 0)
+	assert.NoError(t, err)
+
+	err = KeepAlive("9990", "", remoteAddress, 0)
+	assert.Error(t, err)
+
+	// a worker which gives no weight has the default weight
+	weights, err := GetAllWeights(tcpPort)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{remoteAddress: 1}, weights)
+
+	assert.NoError(t, KeepAlive(tcpPort, "", remoteAddress, 8))
+	weights, err = GetAllWeights(tcpPort)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{remoteAddress: 8}, weights)
+
+	// a heartbeat without weight keeps the registered one
+	assert.NoError(t, KeepAlive(tcpPort, "", remoteAddress, 0))
+	weights, err = GetAllWeights(tcpPort)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{remoteAddress: 8}, weights)
+
+	assert.NoError(t, KeepAlive(tcpPort, "", remoteAddress, WEIGHTRESET))
+	weights, err = GetAllWeights(tcpPort)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{remoteAddress: 1}, weights)
+
+	assert.Error(t, KeepAlive(tcpPort, "", remoteAddress, -2))
+}
+
+func Test_GetAllAliveServerAddresses(t *testing.T) {
+	tcpPort := "9998"
+	assert.NoError(t, OpenGroup(tcpPort))
+	defer stopListenForTests(tcpPort)
+
+	remoteAddress := "127.0.0.1:11121"
+	err := KeepAlive(tcpPort, "", remoteAddress, 0)
+	assert.NoError(t, err)
+
+	addresses, err := GetAllAliveServerAddresses(tcpPort)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{remoteAddress}, addresses)
+
+	_, err = GetAllAliveServerAddresses("9990")
+	assert.Error(t, err)
+}
+
+// stopListenForTests closes the group without persisting it, it returns once all the sessions are drained
+func stopListenForTests(group string) error {
+	service, err := stopAccepting(group)
+	if err != nil {
+		return err
+	}
+
+	drain(group, service)
+	return nil
+}
+
+func Test_ReopenGroup(t *testing.T) {
+	tcpPort := "9997"
+	assert.NoError(t, OpenGroup(tcpPort))
+	assert.Error(t, OpenGroup(tcpPort))
+
+	remoteAddress := "127.0.0.1:11122"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	time.Sleep(200 * time.Millisecond)
+	err := KeepAlive(tcpPort, "", remoteAddress, 0)
+	assert.NoError(t, err)
+
+	// A client payload that looks like the old control package is forwarded untouched
+	clientConn, err := net.Dial("tcp", fmt.Sprintf("localhost:%s", tcpPort))
+	assert.NoError(t, err)
+	data := []byte(`{"type":3}`)
+	_, err = clientConn.Write(data)
+	assert.NoError(t, err)
+	buffer := make([]byte, 1024)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := clientConn.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buffer[:n])
+	clientConn.Close()
+
+	err = stopListenForTests(tcpPort)
+	assert.NoError(t, err)
+
+	err = KeepAlive(tcpPort, "", remoteAddress, 0)
+	assert.Error(t, err)
+	_, err = net.Dial("tcp", fmt.Sprintf("localhost:%s", tcpPort))
+	assert.Error(t, err)
+
+	// restart
+	assert.NoError(t, OpenGroup(tcpPort))
+	defer stopListenForTests(tcpPort)
+
+	err = KeepAlive(tcpPort, "", remoteAddress, 0)
+	assert.NoError(t, err)
+}
+
+func Test_Drain(t *testing.T) {
+	remoteAddress := "127.0.0.1:11132"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("9996")
+	groupConf.Servers = []string{remoteAddress}
+	assert.NoError(t, StartService(groupConf))
+	time.Sleep(200 * time.Millisecond)
+
+	clientConn, err := net.Dial("tcp", "localhost:9996")
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "ping")
+
+	// the closed group refuses new clients while the running session goes on
+	assert.NoError(t, CloseGroup(groupConf.Name))
+	_, err = net.Dial("tcp", "localhost:9996")
+	assert.Error(t, err)
+	assert.NotContains(t, GetAllGroups(), groupConf.Name)
+	status, ok := GetDrainStatus(groupConf.Name)
+	assert.True(t, ok)
+	assert.Equal(t, 1, status.Sessions)
+	assert.Contains(t, GetAllDrainStatus(), groupConf.Name)
+	echoForTests(t, clientConn, "pong")
+
+	clientConn.Close()
+	time.Sleep(300 * time.Millisecond)
+	_, ok = GetDrainStatus(groupConf.Name)
+	assert.False(t, ok)
+}
+
+func Test_DrainDeadline(t *testing.T) {
+	remoteAddress := "127.0.0.1:11133"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("9995")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.DrainTimeout = 300 * time.Millisecond
+	assert.NoError(t, StartService(groupConf))
+	time.Sleep(200 * time.Millisecond)
+
+	clientConn, err := net.Dial("tcp", "localhost:9995")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	echoForTests(t, clientConn, "ping")
+
+	// the session left at the deadline is closed
+	start := time.Now()
+	assert.NoError(t, stopListenForTests(groupConf.Name))
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_OpenGroup(t *testing.T) {
+	remoteAddress := "127.0.0.1:11162"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	conf := config.GetConfig()
+	conf.Groups = []config.GroupConfig{{Name: "open-named", Listen: "11163", LBPolicy: int(lb.ROUNDROBIN), Servers: []string{remoteAddress}}}
+
+	// a configured group is reopened with its own settings
+	assert.NoError(t, openGroup(conf, "open-named"))
+	defer stopListenForTests("open-named")
+	groupConf, err := GetGroupConfig("open-named")
+	assert.NoError(t, err)
+	assert.Equal(t, int(lb.ROUNDROBIN), groupConf.LBPolicy)
+	assert.Equal(t, []string{remoteAddress}, groupConf.Servers)
+	time.Sleep(200 * time.Millisecond)
+	clientConn, err := net.Dial("tcp", "localhost:11163")
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "configured")
+	clientConn.Close()
+
+	// any other group must be a port
+	for _, group := range []string{"", "unknown", "0", "65536"} {
+		assert.Error(t, openGroup(conf, group), group)
+		assert.NotContains(t, GetAllGroups(), group)
+	}
+
+	// the settings are validated before listening
+	conf.LBPolicy = 0
+	assert.Error(t, openGroup(conf, "11164"))
+	assert.NotContains(t, GetAllGroups(), "11164")
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+)
+
+// hashKey returns the key the hashing lb policies use for the session, it falls back to the source ip
+// when the TLS server name is missing. The source is the real client address when the group accepts
+// PROXY headers, so the proxy key is the source ip of the accepted header
+func (service *TCPProxySessionService) hashKey(clientProxySession *TCPProxySession) string {
+	conf := clientProxySession.conf
+	sourceAddr := clientProxySession.clientAddr()
+
+	switch conf.HashKey {
+	case config.HASHKEYADDRESS:
+		return sourceAddr.String()
+	case config.HASHKEYPREFIX:
+		return prefixKey(sourceAddr, conf.HashPrefix, conf.HashPrefix6)
+	case config.HASHKEYSNI:
+		if state := clientProxySession.tlsState; state != nil {
+			if state.ServerName != "" {
+				return state.ServerName
+			}
+			break
+		}
+		if hello := service.peekClientHello(clientProxySession); hello != nil && hello.serverName != "" {
+			return hello.serverName
+		}
+	}
+
+	return ipKey(sourceAddr)
+}
+
+func (service *TCPProxySessionService) peekClientHello(clientProxySession *TCPProxySession) *clientHello {
+	pc := clientProxySession.peek()
+	pc.SetReadDeadline(time.Now().Add(clientProxySession.conf.RWTimeout))
+	defer pc.SetReadDeadline(time.Time{})
+
+	hello, err := peekClientHello(pc.reader)
+	if err != nil {
+		log.Printf("Error to peek TLS ClientHello, clientAddr: %s, error: %s\n", clientProxySession.RemoteAddr(), err)
+	}
+	return hello
+}
+
+// ipKey returns the ip of the address without the port
+func ipKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// prefixKey returns the network of the address, so every client in the same /24 or /64 gets the same backend
+func prefixKey(addr net.Addr, prefix, prefix6 int) string {
+	ip := net.ParseIP(ipKey(addr))
+	if ip == nil {
+		return addr.String()
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(prefix, 32)), Mask: net.CIDRMask(prefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(prefix6, 128)), Mask: net.CIDRMask(prefix6, 128)}).String()
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+func Test_HashKey(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.168.10.20"), Port: 50000}
+	addr6 := &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 50000}
+
+	assert.Equal(t, "192.168.10.20", ipKey(addr))
+	assert.Equal(t, "2001:db8:1:2:3:4:5:6", ipKey(addr6))
+	assert.Equal(t, "192.168.10.0/24", prefixKey(addr, 24, 64))
+	assert.Equal(t, "192.168.0.0/16", prefixKey(addr, 16, 64))
+	assert.Equal(t, "2001:db8:1:2::/64", prefixKey(addr6, 24, 64))
+}
+
+func Test_HashKeyFromStream(t *testing.T) {
+	service := newTCPProxyService(config.GetConfig().NewGroupConfig("0"))
+	defer close(service.stopChan)
+
+	for hashKey, tests := range map[string][]struct {
+		data     string
+		expected string
+	}{
+		config.HASHKEYSNI: {
+			{"payload", "pipe"},
+		},
+	} {
+		for _, test := range tests {
+			client, server := net.Pipe()
+			service.confLock.Lock()
+			service.conf.HashKey = hashKey
+			service.confLock.Unlock()
+
+			clientProxySession := service.add(server, service.getConf(), nil)
+			go client.Write([]byte(test.data))
+			assert.Equal(t, test.expected, service.hashKey(clientProxySession))
+
+			// the peeked bytes are still forwarded
+			buffer := make([]byte, len(test.data))
+			clientProxySession.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := clientProxySession.Read(buffer)
+			assert.NoError(t, err)
+			assert.Equal(t, test.data, string(buffer[:n]))
+
+			service.close(clientProxySession)
+			client.Close()
+		}
+	}
+}
+
+func Test_HashKeyFromAcceptedProxy(t *testing.T) {
+	// without acceptproxy the header would reach the backend as payload, so the proxy key is rejected
+	invalid := config.GetConfig().NewGroupConfig("0")
+	invalid.HashKey = config.HASHKEYPROXY
+	assert.Error(t, invalid.Validate())
+
+	groupConf := config.GetConfig().NewGroupConfig("0")
+	groupConf.AcceptProxy = config.PROXYANY
+	service := newTCPProxyService(groupConf)
+	defer close(service.stopChan)
+
+	for _, hashKey := range []string{config.HASHKEYIP, config.HASHKEYPROXY} {
+		client, server := net.Pipe()
+		service.confLock.Lock()
+		service.conf.HashKey = hashKey
+		service.confLock.Unlock()
+
+		pc := newPeekConn(server)
+		go client.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 4000 80\r\npayload"))
+		header, err := acceptProxyHeader(pc, service.getConf())
+		assert.NoError(t, err)
+		clientProxySession := service.add(pc, service.getConf(), header)
+		assert.Equal(t, "10.1.2.3", service.hashKey(clientProxySession))
+		assert.Equal(t, "10.1.2.3:4000", clientProxySession.clientAddr().String())
+
+		// the accepted header is not forwarded, only the payload is
+		buffer := make([]byte, 7)
+		clientProxySession.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := clientProxySession.Read(buffer)
+		assert.NoError(t, err)
+		assert.Equal(t, "payload", string(buffer[:n]))
+
+		service.close(clientProxySession)
+		client.Close()
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/metrics"
+)
+
+// The limits of a group, named after their settings
+const (
+	LIMITSESSIONS      = "maxsessions"
+	LIMITSESSIONSPERIP = "maxsessionsperip"
+	LIMITRATEPERIP     = "maxrateperip"
+)
+
+// admit waits for the limits of the group to admit the connection of the client address before its session
+// is created, it returns the counted client ip to release and false when the connection is refused
+func (service *TCPProxySessionService) admit(addr net.Addr, conf config.GroupConfig) (string, bool) {
+	ip := ""
+	if _, ok := addr.(*net.UnixAddr); !ok {
+		ip = ipKey(addr)
+	}
+
+	if limit := service.limiter.acquire(conf.Limits, ip, service.stopChan); limit != "" {
+		metrics.SessionsRejected.Inc(conf.Name, limit)
+		log.Printf("Error to admit client session, group: %s, clientAddr: %s, limit: %s\n", conf.Name, addr, limit)
+		return "", false
+	}
+	return ip, true
+}
+
+// rateWindow the new sessions of a client ip in the current second
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// sessionLimiter counts the admitted sessions of a group by client ip. A session over a limit waits in the
+// queue until a session is released, its rate window is over or the queuetimeout expires
+type sessionLimiter struct {
+	lock      sync.Mutex
+	admitted  int
+	ips       map[string]int         // admitted sessions of each client ip
+	rates     map[string]*rateWindow // new sessions of each client ip
+	queued    int
+	released  chan struct{} // closed and replaced every time a session is released
+	lastSweep time.Time
+}
+
+func newSessionLimiter() *sessionLimiter {
+	return &sessionLimiter{
+		ips:      make(map[string]int),
+		rates:    make(map[string]*rateWindow),
+		released: make(chan struct{}),
+	}
+}
+
+// acquire admits a session of the client ip, it returns the exceeded limit when the session is refused.
+// An empty ip, the clients of a unix socket, is only counted by maxsessions
+func (limiter *sessionLimiter) acquire(limits config.LimitsConfig, ip string, stopChan chan struct{}) string {
+	deadline := time.Now().Add(limits.QueueTimeout)
+	queued := false
+
+	limiter.lock.Lock()
+	for {
+		now := time.Now()
+		limiter.sweep(now)
+
+		limit, retry := limiter.exceeded(limits, ip, now)
+		if limit == "" {
+			limiter.admit(limits, ip, now)
+			if queued {
+				limiter.queued--
+			}
+			limiter.lock.Unlock()
+			return ""
+		}
+
+		if !queued {
+			if limiter.queued >= limits.Queue {
+				limiter.lock.Unlock()
+				return limit
+			}
+			limiter.queued++
+			queued = true
+		}
+
+		wait := deadline.Sub(now)
+		if wait <= 0 {
+			limiter.queued--
+			limiter.lock.Unlock()
+			return limit
+		}
+		if !retry.IsZero() && retry.Sub(now) < wait {
+			wait = retry.Sub(now)
+		}
+
+		released := limiter.released
+		limiter.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+		case <-timer.C:
+		case <-stopChan:
+			// The group is closing, the queued sessions are not worth waiting for
+			timer.Stop()
+			limiter.lock.Lock()
+			limiter.queued--
+			limiter.lock.Unlock()
+			return limit
+		}
+		timer.Stop()
+		limiter.lock.Lock()
+	}
+}
+
+// exceeded returns the first limit the new session of the ip is over, and when the rate window of the ip is over
+func (limiter *sessionLimiter) exceeded(limits config.LimitsConfig, ip string, now time.Time) (string, time.Time) {
+	if limits.MaxSessions > 0 && limiter.admitted >= limits.MaxSessions {
+		return LIMITSESSIONS, time.Time{}
+	}
+	if ip == "" {
+		return "", time.Time{}
+	}
+	if limits.MaxSessionsPerIP > 0 && limiter.ips[ip] >= limits.MaxSessionsPerIP {
+		return LIMITSESSIONSPERIP, time.Time{}
+	}
+	if window, ok := limiter.rates[ip]; ok && limits.MaxRatePerIP > 0 && now.Sub(window.start) < time.Second && window.count >= limits.MaxRatePerIP {
+		return LIMITRATEPERIP, window.start.Add(time.Second)
+	}
+	return "", time.Time{}
+}
+
+func (limiter *sessionLimiter) admit(limits config.LimitsConfig, ip string, now time.Time) {
+	limiter.admitted++
+	if ip == "" {
+		return
+	}
+
+	limiter.ips[ip]++
+	if limits.MaxRatePerIP > 0 {
+		window, ok := limiter.rates[ip]
+		if !ok || now.Sub(window.start) >= time.Second {
+			window = &rateWindow{start: now}
+			limiter.rates[ip] = window
+		}
+		window.count++
+	}
+}
+
+// sweep forgets the rate windows which are over, at most once a second
+func (limiter *sessionLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < time.Second {
+		return
+	}
+
+	limiter.lastSweep = now
+	for ip, window := range limiter.rates {
+		if now.Sub(window.start) >= time.Second {
+			delete(limiter.rates, ip)
+		}
+	}
+}
+
+// release frees the slot of an admitted session and wakes up the queue
+func (limiter *sessionLimiter) release(ip string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.admitted--
+	if ip != "" {
+		if limiter.ips[ip]--; limiter.ips[ip] <= 0 {
+			delete(limiter.ips, ip)
+		}
+	}
+	close(limiter.released)
+	limiter.released = make(chan struct{})
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/metrics"
+)
+
+// refusedForTests expects the proxy to close the session without dialing any backend
+func refusedForTests(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+}
+
+func startLimitedGroupForTests(t *testing.T, listen string, limits config.LimitsConfig) config.GroupConfig {
+	groupConf := config.GetConfig().NewGroupConfig(listen)
+	groupConf.Servers = []string{"127.0.0.1:11155"}
+	groupConf.Limits = limits
+	assert.NoError(t, groupConf.Validate())
+	assert.NoError(t, StartService(groupConf))
+	time.Sleep(200 * time.Millisecond)
+	return groupConf
+}
+
+func Test_Limits(t *testing.T) {
+	go startEchoRemoteForTests("127.0.0.1:11155", make(chan struct{}, 100))
+
+	// the second session of the client ip is refused at once
+	groupConf := startLimitedGroupForTests(t, "11156", config.LimitsConfig{MaxSessionsPerIP: 1})
+	defer stopListenForTests(groupConf.Name)
+
+	first, err := net.Dial("tcp", "localhost:11156")
+	assert.NoError(t, err)
+	echoForTests(t, first, "first")
+	second, err := net.Dial("tcp", "localhost:11156")
+	assert.NoError(t, err)
+	refusedForTests(t, second)
+	second.Close()
+	assert.Equal(t, float64(1), metrics.SessionsRejected.Value(groupConf.Name, LIMITSESSIONSPERIP))
+
+	// the slot is free again once the session is closed
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	third, err := net.Dial("tcp", "localhost:11156")
+	assert.NoError(t, err)
+	echoForTests(t, third, "third")
+	third.Close()
+
+	// a session waits in the queue for a free slot, the one over the queue is refused
+	groupConf = startLimitedGroupForTests(t, "11157", config.LimitsConfig{MaxSessions: 1, Queue: 1, QueueTimeout: 2 * time.Second})
+	defer stopListenForTests(groupConf.Name)
+
+	first, err = net.Dial("tcp", "localhost:11157")
+	assert.NoError(t, err)
+	echoForTests(t, first, "first")
+	queued, err := net.Dial("tcp", "localhost:11157")
+	assert.NoError(t, err)
+	defer queued.Close()
+	time.Sleep(100 * time.Millisecond)
+	refused, err := net.Dial("tcp", "localhost:11157")
+	assert.NoError(t, err)
+	refusedForTests(t, refused)
+	refused.Close()
+
+	// the queued and refused connections are not sessions
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	service.lock.RLock()
+	assert.Len(t, service.proxySessions, 1)
+	service.lock.RUnlock()
+	assert.Equal(t, float64(1), metrics.SessionsAccepted.Value(groupConf.Name))
+
+	first.Close()
+	echoForTests(t, queued, "queued")
+	assert.Equal(t, float64(1), metrics.SessionsRejected.Value(groupConf.Name, LIMITSESSIONS))
+
+	// the new sessions of the client ip over the rate are refused until the next second
+	groupConf = startLimitedGroupForTests(t, "11158", config.LimitsConfig{MaxRatePerIP: 2})
+	defer stopListenForTests(groupConf.Name)
+
+	for _, message := range []string{"a", "b"} {
+		conn, err := net.Dial("tcp", "localhost:11158")
+		assert.NoError(t, err)
+		echoForTests(t, conn, message)
+		conn.Close()
+	}
+	conn, err := net.Dial("tcp", "localhost:11158")
+	assert.NoError(t, err)
+	refusedForTests(t, conn)
+	conn.Close()
+	assert.Equal(t, float64(1), metrics.SessionsRejected.Value(groupConf.Name, LIMITRATEPERIP))
+
+	time.Sleep(time.Second)
+	conn, err = net.Dial("tcp", "localhost:11158")
+	assert.NoError(t, err)
+	echoForTests(t, conn, "c")
+	conn.Close()
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"github.com/wangff15386/goproxy/services/metrics"
+)
+
+// The gauges of the groups, collected from the registry at every scrape
+var (
+	_ = metrics.NewGaugeFunc("goproxy_sessions_active", "Client sessions running, including the ones of the draining groups.", collectActiveSessions, "group")
+	_ = metrics.NewGaugeFunc("goproxy_backend_sessions_active", "Client sessions running on each backend.", collectBackendSessions, "group", "backend")
+	_ = metrics.NewGaugeFunc("goproxy_backends_alive", "Backends selectable by the lb policy, in all the pools.", collectAliveBackends, "group")
+	_ = metrics.NewGaugeFunc("goproxy_backends_registered", "Backends registered by heartbeats, the static servers are not included.", collectRegisteredBackends, "group")
+)
+
+// runningGroups returns the opened and the draining groups, a draining group reopened meanwhile is reported once
+func runningGroups() map[string]*TCPProxySessionService {
+	groupLock.RLock()
+	defer groupLock.RUnlock()
+
+	running := make(map[string]*TCPProxySessionService, len(groups)+len(draining))
+	for name, service := range draining {
+		running[name] = service
+	}
+	for name, service := range groups {
+		running[name] = service
+	}
+	return running
+}
+
+func collectActiveSessions(emit func(value float64, labelValues ...string)) {
+	sessions := make(map[string]int)
+	groupLock.RLock()
+	for name, service := range draining {
+		sessions[name] += service.drainStatus().Sessions
+	}
+	for name, service := range groups {
+		service.lock.RLock()
+		sessions[name] += len(service.proxySessions)
+		service.lock.RUnlock()
+	}
+	groupLock.RUnlock()
+
+	for name, count := range sessions {
+		emit(float64(count), name)
+	}
+}
+
+func collectBackendSessions(emit func(value float64, labelValues ...string)) {
+	for name, service := range runningGroups() {
+		service.backendLock.RLock()
+		for address, count := range service.backendSessions {
+			emit(float64(count), name, address)
+		}
+		service.backendLock.RUnlock()
+	}
+}
+
+func collectAliveBackends(emit func(value float64, labelValues ...string)) {
+	for name, service := range runningGroups() {
+		alive := 0
+		for _, pool := range service.getPools() {
+			alive += len(pool.disc.GetAllAliveRemoteAddresses())
+		}
+		emit(float64(alive), name)
+	}
+}
+
+func collectRegisteredBackends(emit func(value float64, labelValues ...string)) {
+	for name, service := range runningGroups() {
+		emit(float64(len(service.disc.GetAllRegisteredRemoteAddresses())), name)
+	}
+}
+
+// forgetBackendMetrics deletes the series of a backend which left the group
+func forgetBackendMetrics(group, address string) {
+	for _, counter := range []*metrics.CounterVec{metrics.BytesIn, metrics.BytesOut, metrics.DialErrors, metrics.Heartbeats} {
+		counter.Delete(group, address)
+	}
+	for _, histogram := range []*metrics.HistogramVec{metrics.DialDuration, metrics.SessionDuration} {
+		histogram.Delete(group, address)
+	}
+}
+
+// forgetGroupMetrics deletes all the series of a closed group
+func forgetGroupMetrics(group string) {
+	for _, counter := range []*metrics.CounterVec{metrics.SessionsAccepted, metrics.SessionsClosed, metrics.SessionsRejected,
+		metrics.BytesIn, metrics.BytesOut, metrics.DialErrors, metrics.Heartbeats} {
+		counter.Delete(group)
+	}
+	for _, histogram := range []*metrics.HistogramVec{metrics.DialDuration, metrics.SessionDuration} {
+		histogram.Delete(group)
+	}
+}
+
+// forgetBackend deletes the metrics of an expired backend unless another pool of the group still has it
+func (service *TCPProxySessionService) forgetBackend(address string) {
+	conf := service.getConf()
+	known := append([]string(nil), conf.Servers...)
+	for _, poolConf := range conf.Pools {
+		known = append(known, poolConf.Servers...)
+	}
+	for _, pool := range service.getPools() {
+		known = append(known, pool.disc.GetAllRegisteredRemoteAddresses()...)
+	}
+
+	for _, other := range known {
+		if other == address {
+			return
+		}
+	}
+	forgetBackendMetrics(conf.Name, address)
+}
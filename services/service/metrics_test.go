@@ -0,0 +1,82 @@
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/lb"
+	"github.com/wangff15386/goproxy/services/metrics"
+)
+
+func Test_Metrics(t *testing.T) {
+	deadAddress, remoteAddress := "127.0.0.1:11134", "127.0.0.1:11135"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11114")
+	groupConf.Name = "metrics-tests"
+	groupConf.LBPolicy = int(lb.HA)
+	groupConf.Servers = []string{deadAddress}
+	assert.NoError(t, StartService(groupConf))
+	assert.NoError(t, KeepAlive(groupConf.Name, "", remoteAddress, 0))
+	time.Sleep(200 * time.Millisecond)
+
+	clientConn, err := net.Dial("tcp", "localhost:11114")
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "ping")
+
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+	scrape := func() string {
+		resp, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	body := scrape()
+	for _, line := range []string{
+		`goproxy_sessions_accepted_total{group="metrics-tests"} 1`,
+		`goproxy_sessions_active{group="metrics-tests"} 1`,
+		`goproxy_backend_sessions_active{group="metrics-tests",backend="127.0.0.1:11135"} 1`,
+		`goproxy_backends_alive{group="metrics-tests"} 2`,
+		`goproxy_backends_registered{group="metrics-tests"} 1`,
+		`goproxy_heartbeats_total{group="metrics-tests",backend="127.0.0.1:11135"} 1`,
+		`goproxy_dial_errors_total{group="metrics-tests",backend="127.0.0.1:11134"} 1`,
+		`goproxy_dial_duration_seconds_count{group="metrics-tests",backend="127.0.0.1:11135"} 1`,
+		`goproxy_bytes_in_total{group="metrics-tests",backend="127.0.0.1:11135"} 4`,
+		`goproxy_bytes_out_total{group="metrics-tests",backend="127.0.0.1:11135"} 4`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+
+	clientConn.Close()
+	time.Sleep(100 * time.Millisecond)
+	body = scrape()
+	assert.Contains(t, body, `goproxy_sessions_closed_total{group="metrics-tests"} 1`+"\n")
+	assert.Contains(t, body, `goproxy_sessions_active{group="metrics-tests"} 0`+"\n")
+	assert.Contains(t, body, `goproxy_session_duration_seconds_count{group="metrics-tests",backend="127.0.0.1:11135"} 1`+"\n")
+
+	// the series of an expired worker are deleted, the ones of a server still in the group are kept
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	metrics.Heartbeats.Inc(groupConf.Name, "127.0.0.1:11136")
+	for _, address := range []string{"127.0.0.1:11136", deadAddress, remoteAddress} {
+		service.forgetBackend(address)
+	}
+	body = scrape()
+	assert.NotContains(t, body, `backend="127.0.0.1:11136"`)
+	assert.Contains(t, body, `goproxy_dial_errors_total{group="metrics-tests",backend="127.0.0.1:11134"} 1`+"\n")
+	assert.Contains(t, body, `goproxy_heartbeats_total{group="metrics-tests",backend="127.0.0.1:11135"} 1`+"\n")
+
+	// all the series of a closed group are deleted
+	assert.NoError(t, stopListenForTests(groupConf.Name))
+	assert.NotContains(t, scrape(), `group="metrics-tests"`)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+)
+
+// PEEKBUFFERSIZE is big enough for a whole TLS record or a PROXY v2 header with its TLVs
+const PEEKBUFFERSIZE = 20 * 1024
+
+// peekConn lets the proxy look at the first bytes of a client connection without consuming them,
+// everything peeked is still forwarded to the backend
+type peekConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	if pc, ok := conn.(*peekConn); ok {
+		return pc
+	}
+
+	return &peekConn{Conn: conn, reader: bufio.NewReaderSize(conn, PEEKBUFFERSIZE)}
+}
+
+// Read implements net.Conn, the peeked bytes are returned first
+func (pc *peekConn) Read(b []byte) (int, error) {
+	return pc.reader.Read(b)
+}
+
+// peekPrefix reports whether the stream starts with prefix, it only waits for more bytes
+// as long as the bytes received so far still match, so a short payload is never held up
+func peekPrefix(reader *bufio.Reader, prefix []byte) bool {
+	for n := 1; ; n++ {
+		if buffered := reader.Buffered(); buffered > n {
+			n = buffered
+		}
+		if n > len(prefix) {
+			n = len(prefix)
+		}
+
+		data, err := reader.Peek(n)
+		if !bytes.HasPrefix(prefix, data) {
+			return false
+		}
+		if len(data) == len(prefix) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
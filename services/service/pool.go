@@ -0,0 +1,115 @@
+package service
+
+import (
+	"log"
+	"sort"
+
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/discovery"
+	"github.com/wangff15386/goproxy/services/lb"
+)
+
+// backendPool the remote addresses of one pool of a group and the lb policies picking among them,
+// the default pool is the discovery of the group itself
+type backendPool struct {
+	name      string
+	disc      *discovery.Service
+	lbFactory *lb.PolicyFactory
+	removed   chan struct{} // closed when a reload removes the pool
+}
+
+// newBackendPool starts the discovery of a named pool, it stops with the group or once the pool is removed
+func (service *TCPProxySessionService) newBackendPool(poolConf config.PoolConfig, groupConf config.GroupConfig) *backendPool {
+	stopChan := make(chan struct{})
+	pool := &backendPool{
+		name:      poolConf.Name,
+		disc:      discovery.NewServiceDiscovery(stopChan, poolConf.Servers...),
+		lbFactory: lb.InitFactory(service, service.lbOptions...),
+		removed:   make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-service.stopChan:
+		case <-pool.removed:
+		}
+		close(stopChan)
+	}()
+
+	pool.disc.OnExpire(service.forgetBackend)
+	pool.disc.SetProbeDialer(service.dialProbe)
+	pool.disc.OnChange(func() {
+		persistPoolWorkers(groupConf.Name, pool.name, pool.disc.GetAllRegisteredRemoteAddresses())
+	})
+	pool.disc.SetHealthCheck(groupConf.HealthCheck)
+	pool.disc.SetOutlierDetection(groupConf.OutlierDetection)
+	return pool
+}
+
+// updatePools applies the pools of the new settings, it must be called with the confLock held
+func (service *TCPProxySessionService) updatePools(groupConf config.GroupConfig) {
+	declared := make(map[string]struct{})
+	for _, poolConf := range groupConf.Pools {
+		declared[poolConf.Name] = struct{}{}
+		pool, ok := service.pools[poolConf.Name]
+		if !ok {
+			service.pools[poolConf.Name] = service.newBackendPool(poolConf, groupConf)
+			continue
+		}
+
+		pool.disc.SetStaticAddresses(poolConf.Servers)
+		pool.disc.SetHealthCheck(groupConf.HealthCheck)
+		pool.disc.SetOutlierDetection(groupConf.OutlierDetection)
+	}
+
+	for name, pool := range service.pools {
+		if _, ok := declared[name]; !ok && name != "" {
+			close(pool.removed)
+			delete(service.pools, name)
+			persistPoolWorkers(groupConf.Name, name, nil)
+		}
+	}
+}
+
+func (service *TCPProxySessionService) getPool(name string) (*backendPool, bool) {
+	service.confLock.RLock()
+	defer service.confLock.RUnlock()
+
+	pool, ok := service.pools[name]
+	return pool, ok
+}
+
+// getPools returns the default pool and the named pools in ascending order of their names
+func (service *TCPProxySessionService) getPools() []*backendPool {
+	service.confLock.RLock()
+	defer service.confLock.RUnlock()
+
+	pools := make([]*backendPool, 0, len(service.pools))
+	for _, pool := range service.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].name < pools[j].name })
+	return pools
+}
+
+// route picks the pool of the session from the routes of the group. The ClientHello is peeked before any
+// TLS is terminated so the offered ALPN protocols are known, a session without a TLS ClientHello takes
+// the default pool
+func (service *TCPProxySessionService) route(clientProxySession *TCPProxySession) *backendPool {
+	conf := clientProxySession.conf
+	name := ""
+	if len(conf.Routes) > 0 {
+		hello := service.peekClientHello(clientProxySession)
+		if hello == nil {
+			hello = &clientHello{}
+		}
+		name = conf.Route(hello.serverName, hello.protocols)
+	}
+
+	pool, ok := service.getPool(name)
+	if !ok {
+		// The pool is removed by a reload after the session was accepted
+		log.Printf("Error to find pool %s, group: %s, the default pool is used\n", name, conf.Name)
+		pool, _ = service.getPool("")
+	}
+	return pool
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+// startNamedRemoteForTests answers the forwarded ClientHello with its name and the server name it reads
+func startNamedRemoteForTests(t *testing.T, address, name string) {
+	lis, err := net.Listen("tcp", address)
+	assert.NoError(t, err)
+
+	go func() {
+		defer lis.Close()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				hello, err := peekClientHello(bufio.NewReaderSize(conn, PEEKBUFFERSIZE))
+				if err != nil || hello == nil {
+					fmt.Fprintf(conn, "%s no ClientHello", name)
+					return
+				}
+				fmt.Fprintf(conn, "%s %s", name, hello.serverName)
+			}()
+		}
+	}()
+}
+
+// clientHelloBytesForTests returns the first TLS record sent by a real TLS client
+func clientHelloBytesForTests(conf *tls.Config) []byte {
+	reader := clientHelloForTests(conf)
+	header, _ := reader.Peek(tlsRecordHeaderLength)
+	record, _ := reader.Peek(tlsRecordHeaderLength + int(binary.BigEndian.Uint16(header[3:5])))
+	return append([]byte(nil), record...)
+}
+
+func routeForTests(t *testing.T, listen string, conf *tls.Config) string {
+	conn, err := net.Dial("tcp", "localhost:"+listen)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(clientHelloBytesForTests(conf))
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func Test_Routes(t *testing.T) {
+	startNamedRemoteForTests(t, "127.0.0.1:11144", "default")
+	startNamedRemoteForTests(t, "127.0.0.1:11145", "web")
+	startNamedRemoteForTests(t, "127.0.0.1:11146", "h2")
+
+	groupConf := config.GetConfig().NewGroupConfig("11147")
+	groupConf.Servers = []string{"127.0.0.1:11144"}
+	groupConf.Pools = []config.PoolConfig{{Name: "web", Servers: []string{"127.0.0.1:11145"}}, {Name: "h2", Servers: []string{"127.0.0.1:11146"}}}
+	groupConf.Routes = []config.RouteConfig{
+		{ServerNames: []string{"*.example.com"}, ALPN: []string{"h2"}, Pool: "h2"},
+		{ServerNames: []string{"*.example.com"}, Pool: "web"},
+	}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// the ClientHello reaches the backend of the pool untouched
+	assert.Equal(t, "h2 api.example.com", routeForTests(t, "11147", &tls.Config{ServerName: "api.example.com", NextProtos: []string{"h2"}}))
+	assert.Equal(t, "web api.example.com", routeForTests(t, "11147", &tls.Config{ServerName: "api.example.com"}))
+	assert.Equal(t, "default other.org", routeForTests(t, "11147", &tls.Config{ServerName: "other.org"}))
+
+	pools, err := GetAllPools(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"web": {"127.0.0.1:11145"}, "h2": {"127.0.0.1:11146"}}, pools)
+
+	// a removed pool is stopped and its route is gone
+	groupConf.Pools = groupConf.Pools[:1]
+	groupConf.Routes = groupConf.Routes[1:]
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	service.reconfigure(groupConf)
+	assert.Equal(t, "web api.example.com", routeForTests(t, "11147", &tls.Config{ServerName: "api.example.com", NextProtos: []string{"h2"}}))
+	pools, err = GetAllPools(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"web": {"127.0.0.1:11145"}}, pools)
+
+	// a session without a ClientHello takes the default pool
+	conn, err := net.Dial("tcp", "localhost:11147")
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "default no ClientHello", string(data))
+}
+
+func Test_PoolKeepAlive(t *testing.T) {
+	startNamedRemoteForTests(t, "127.0.0.1:11165", "web")
+
+	groupConf := config.GetConfig().NewGroupConfig("11166")
+	groupConf.Pools = []config.PoolConfig{{Name: "web"}}
+	groupConf.Routes = []config.RouteConfig{{ServerNames: []string{"*.example.com"}, Pool: "web"}}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// a worker registers to the named pool with its weight
+	assert.NoError(t, KeepAlive(groupConf.Name, "web", "127.0.0.1:11165", 3))
+	assert.Error(t, KeepAlive(groupConf.Name, "unknown", "127.0.0.1:11165", 0))
+	assert.Equal(t, "web api.example.com", routeForTests(t, "11166", &tls.Config{ServerName: "api.example.com"}))
+
+	pools, err := GetAllPools(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"web": {"127.0.0.1:11165"}}, pools)
+	list, err := GetAllAliveServerAddresses(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, service.Weight("127.0.0.1:11165"))
+
+	// the workers of the pool are persisted apart from the default pool
+	stateLock.Lock()
+	assert.Equal(t, []string{"127.0.0.1:11165"}, state.PoolWorkers[groupConf.Name]["web"])
+	assert.Empty(t, state.Workers[groupConf.Name])
+	stateLock.Unlock()
+}
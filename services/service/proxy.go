@@ -1,88 +1,287 @@
 package service
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/wangff15386/goproxy/config"
 	"github.com/wangff15386/goproxy/services/discovery"
 	"github.com/wangff15386/goproxy/services/lb"
+	"github.com/wangff15386/goproxy/services/metrics"
 )
 
-// TCP package type 1: HeartBeat, 2: GetAllAliveServers, 3: StopListen, other: ReverseProxy
-const (
-	HEARTBEAT = iota + 1
-	GETALLALIVESERVERS
-	STOPLISTEN
-)
-
-// TCPPackage for proxy service
-type TCPPackage struct {
-	Type    int    `json:"type"`
-	Content []byte `json:"content"`
-}
-
 // TCPProxySession 当有client连接进来时 创建TCPProxySession对象
+// A session picks its backend once at accept time and holds that connection for its whole life,
+// bytes are copied full-duplex until either side closes. Each client address of an udp group is a session too
 type TCPProxySession struct {
 	net.Conn
+
+	conf       config.GroupConfig // the group settings when the session was accepted
+	serverConn net.Conn           // the backend connection picked by the lb policy
+	address    string             // the backend address of serverConn
+	pool       string             // the pool picked by the routes, empty for the default pool
+	lastActive int64              // unix nano of the last read or write on either side
+	accepted   time.Time
+
+	id       string // session id of the access log
+	bytesIn  int64  // bytes from the client to the backend
+	bytesOut int64  // bytes from the backend to the client
+	reason   string // termination reason, set once the session is finished
+	killed   int32  // 1 when force closed by the drain
+
+	proxyHeader *proxyHeader         // the PROXY header accepted from the load balancer in front of the proxy
+	tlsState    *tls.ConnectionState // the TLS terminated by the group
+}
+
+// clientAddr returns the real client address, the source address of the accepted PROXY header if any
+func (session *TCPProxySession) clientAddr() net.Addr {
+	return sourceAddr(session.Conn, session.proxyHeader)
+}
+
+// sourceAddr returns the real client address of the connection, the source address of the PROXY header if any
+func sourceAddr(conn net.Conn, header *proxyHeader) net.Addr {
+	if header != nil && header.sourceAddr != nil {
+		return header.sourceAddr
+	}
+	return conn.RemoteAddr()
+}
+
+// peek returns the client connection whose first bytes can be looked at before they are forwarded,
+// it is wrapped when the session is added
+func (session *TCPProxySession) peek() *peekConn {
+	return session.Conn.(*peekConn)
+}
+
+// needsPeek reports whether the group looks at the first bytes of every session
+func needsPeek(conf config.GroupConfig) bool {
+	return conf.AcceptProxy != "" || conf.HashKey == config.HASHKEYSNI || len(conf.Routes) > 0
+}
+
+// touch records a read or write on either side of the session
+func (session *TCPProxySession) touch() {
+	atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+}
+
+// idle returns how long the session has neither read nor written
+func (session *TCPProxySession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&session.lastActive)))
 }
 
 // TCPProxySessionService 所有TCPProxySession使用ProxySessionService进行状态监测和生命周期管理
 type TCPProxySessionService struct {
 	disc          *discovery.Service
 	lbFactory     *lb.PolicyFactory
-	proxySessions map[string]*TCPProxySession
+	proxySessions map[string]*TCPProxySession // keyed by the session id, the clients of a unix socket have no address
 	lock          sync.RWMutex
 	listenr       net.Listener
-	conf          config.ProxyConfig
+	conf          config.GroupConfig
+	tlsConfig     *tls.Config             // nil when the group terminates no TLS
+	backendTLS    *tls.Config             // nil when the backends are dialed in plaintext
+	pools         map[string]*backendPool // the default pool under the empty name and the named pools
+	limiter       *sessionLimiter
+	denyLog       denyLog
+	lbOptions     []lb.FactoryOption // the policies of the lb factories of every pool
+	confLock      sync.RWMutex
 	stopChan      chan struct{}
+	drainDeadline time.Time // set when the group stops accepting
+
+	backendSessions map[string]int // live session count of each backend address
+	backendLock     sync.RWMutex
 }
 
-func newTCPProxyService() *TCPProxySessionService {
+func newTCPProxyService(groupConf config.GroupConfig, lbOptions ...lb.FactoryOption) *TCPProxySessionService {
 	stopChan := make(chan struct{})
 
-	return &TCPProxySessionService{
-		disc:          discovery.NewServiceDiscovery(stopChan),
-		lbFactory:     lb.InitFactory(),
-		proxySessions: make(map[string]*TCPProxySession, 0),
-		conf:          config.GetConfig(),
-		stopChan:      stopChan,
+	service := &TCPProxySessionService{
+		disc:            discovery.NewServiceDiscovery(stopChan, groupConf.Servers...),
+		proxySessions:   make(map[string]*TCPProxySession, 0),
+		conf:            groupConf,
+		stopChan:        stopChan,
+		limiter:         newSessionLimiter(),
+		backendSessions: make(map[string]int),
+		lbOptions:       lbOptions,
+	}
+	service.lbFactory = lb.InitFactory(service, lbOptions...)
+	service.disc.OnExpire(service.forgetBackend)
+	service.disc.SetProbeDialer(service.dialProbe)
+	service.disc.SetHealthCheck(groupConf.HealthCheck)
+	service.disc.SetOutlierDetection(groupConf.OutlierDetection)
+
+	service.pools = map[string]*backendPool{"": {disc: service.disc, lbFactory: service.lbFactory}}
+	service.updatePools(groupConf)
+	return service
+}
+
+// Weight implements lb.IBackendInfo, a worker which gives no weight has the default weight of the group
+func (service *TCPProxySessionService) Weight(address string) int {
+	service.confLock.RLock()
+	for _, pool := range service.pools {
+		if weight := pool.disc.Weight(address); weight > 0 {
+			service.confLock.RUnlock()
+			return weight
+		}
+	}
+	service.confLock.RUnlock()
+
+	return service.getConf().DefaultWeight
+}
+
+// Connections implements lb.IBackendInfo
+func (service *TCPProxySessionService) Connections(address string) int {
+	service.backendLock.RLock()
+	defer service.backendLock.RUnlock()
+
+	return service.backendSessions[address]
+}
+
+// acquireBackend records a session using the backend address, it is counted from the pick so that
+// the concurrent picks see each other
+func (service *TCPProxySessionService) acquireBackend(address string) {
+	service.backendLock.Lock()
+	defer service.backendLock.Unlock()
+
+	service.backendSessions[address]++
+}
+
+// releaseBackend releases the count once the session stops using the backend address
+func (service *TCPProxySessionService) releaseBackend(address string) {
+	service.backendLock.Lock()
+	defer service.backendLock.Unlock()
+
+	if service.backendSessions[address]--; service.backendSessions[address] <= 0 {
+		delete(service.backendSessions, address)
 	}
 }
 
-// StartService start the TCP proxy session service
-func StartService(tcpPort string) error {
-	log.Println("Starting proxy service")
+// StartService start the TCP proxy session service of a group, it returns once the port is listening
+func StartService(groupConf config.GroupConfig) error {
+	return startService(groupConf)
+}
+
+// startService starts the group with its lb policies customized before any session is accepted
+func startService(groupConf config.GroupConfig, lbOptions ...lb.FactoryOption) error {
+	service, err := prepareService(groupConf, lbOptions...)
+	if err != nil {
+		return err
+	}
 
-	service := newTCPProxyService()
-	if tcpPort == "" {
-		tcpPort = service.conf.TCPPort
+	if err = register(groupConf.Name, service); err != nil {
+		service.abort()
+		return err
 	}
+	service.activate()
+	return nil
+}
+
+// prepareService creates the group and binds its listener, it accepts no session until it is registered and activated
+func prepareService(groupConf config.GroupConfig, lbOptions ...lb.FactoryOption) (*TCPProxySessionService, error) {
+	log.Printf("Starting proxy service, group: %s\n", groupConf.Name)
+
+	service := newTCPProxyService(groupConf, lbOptions...)
 
 	var err error
-	service.listenr, err = net.Listen("tcp", fmt.Sprintf("localhost:%s", tcpPort))
+	if service.tlsConfig, err = newServerTLSConfig(groupConf.TLS); err != nil {
+		close(service.stopChan)
+		return nil, errors.WithMessage(err, fmt.Sprintf("Error to start group %s", groupConf.Name))
+	}
+	if service.backendTLS, err = newBackendTLSConfig(groupConf.BackendTLS); err != nil {
+		close(service.stopChan)
+		return nil, errors.WithMessage(err, fmt.Sprintf("Error to start group %s", groupConf.Name))
+	}
+
+	service.listenr, err = listen(groupConf)
 	if err != nil {
-		return fmt.Errorf("Error to listen tcp service, port: %s, err: %s", tcpPort, err)
+		close(service.stopChan)
+		return nil, fmt.Errorf("Error to listen %s service, address: %s, err: %s", groupConf.Type, groupConf.ListenAddress(), err)
+	}
+	// The datagrams of a denied udp client are dropped before any flow is created
+	if udp, ok := service.listenr.(*udpListener); ok {
+		udp.setFilter(func(addr net.Addr) bool { return service.allowed(addr, service.getConf()) })
 	}
-	log.Println("Start to listen tcp port:", tcpPort)
+	return service, nil
+}
 
+// abort releases a prepared group which could not be registered
+func (service *TCPProxySessionService) abort() {
+	close(service.stopChan)
+	service.listenr.Close()
+}
+
+// activate starts accepting the sessions of a registered group
+func (service *TCPProxySessionService) activate() {
+	groupConf := service.getConf()
+	log.Printf("Start to listen %s address: %s, group: %s\n", groupConf.Type, groupConf.ListenAddress(), groupConf.Name)
+
+	service.disc.OnChange(func() {
+		persistWorkers(groupConf.Name, service.disc.GetAllRegisteredRemoteAddresses())
+	})
 	go service.periodicalPrint()
+	go service.serve()
+}
 
-	for {
-		select {
-		case <-service.stopChan:
-			return nil
-		default:
+// listen opens the listener of the group: a tcp or udp port on the bind host, or a unix domain socket.
+// The wildcard bind host listens on ipv4 and ipv6 at the same time
+func listen(groupConf config.GroupConfig) (net.Listener, error) {
+	network, address := config.SplitNetwork(groupConf.Type, groupConf.ListenAddress())
+	switch network {
+	case "unix":
+		return listenUnix(address)
+	case config.GROUPUDP:
+		return listenUDP(address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// OpenGroup 打开端口监听, a configured group is opened with its configured settings, any other group must be a port
+// and inherits all the global settings. The opening is persisted to the state file
+func OpenGroup(group string) error {
+	return openGroup(config.GetConfig(), group)
+}
+
+func openGroup(conf config.ProxyConfig, group string) error {
+	groupConf, configured := conf.FindGroup(group)
+	if !configured {
+		if port, err := strconv.Atoi(group); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("Error to open group %q, it is neither configured nor a port", group)
 		}
+		groupConf = conf.NewGroupConfig(group)
+	}
 
+	stateLock.Lock()
+	groupConf = withStateACL(groupConf, state)
+	stateLock.Unlock()
+	if err := groupConf.Validate(); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("Error to open group %s", group))
+	}
+	if err := StartService(groupConf); err != nil {
+		return err
+	}
+
+	persistOpened(groupConf, configured)
+	return nil
+}
+
+func (service *TCPProxySessionService) serve() {
+	for {
 		conn, err := service.listenr.Accept()
 		if err != nil {
+			select {
+			case <-service.stopChan:
+				return
+			default:
+			}
+
 			log.Printf("Error to establish connection :%v\n", err)
 			continue
 		}
@@ -91,77 +290,164 @@ func StartService(tcpPort string) error {
 	}
 }
 
+func (service *TCPProxySessionService) getTLSConfig() *tls.Config {
+	service.confLock.RLock()
+	defer service.confLock.RUnlock()
+
+	return service.tlsConfig
+}
+
+func (service *TCPProxySessionService) getBackendTLSConfig() *tls.Config {
+	service.confLock.RLock()
+	defer service.confLock.RUnlock()
+
+	return service.backendTLS
+}
+
+func (service *TCPProxySessionService) getConf() config.GroupConfig {
+	service.confLock.RLock()
+	defer service.confLock.RUnlock()
+
+	return service.conf
+}
+
+// reconfigure applies the new settings to the new sessions, the running sessions keep their settings
+func (service *TCPProxySessionService) reconfigure(groupConf config.GroupConfig) {
+	service.confLock.Lock()
+	if !reflect.DeepEqual(service.conf.TLS, groupConf.TLS) {
+		// A broken certificate keeps the TLS settings before, the new sessions must not fail the handshake
+		if tlsConfig, err := newServerTLSConfig(groupConf.TLS); err != nil {
+			log.Printf("%s, group: %s\n", err, groupConf.Name)
+			groupConf.TLS = service.conf.TLS
+		} else {
+			service.tlsConfig = tlsConfig
+		}
+	}
+	if !reflect.DeepEqual(service.conf.BackendTLS, groupConf.BackendTLS) {
+		if backendTLS, err := newBackendTLSConfig(groupConf.BackendTLS); err != nil {
+			log.Printf("%s, group: %s\n", err, groupConf.Name)
+			groupConf.BackendTLS = service.conf.BackendTLS
+		} else {
+			service.backendTLS = backendTLS
+		}
+	}
+	service.updatePools(groupConf)
+	service.conf = groupConf
+	service.confLock.Unlock()
+
+	service.disc.SetStaticAddresses(groupConf.Servers)
+	service.disc.SetHealthCheck(groupConf.HealthCheck)
+	service.disc.SetOutlierDetection(groupConf.OutlierDetection)
+	log.Printf("Reconfigured proxy service, group: %s, settings: %+v\n", groupConf.Name, groupConf)
+}
+
 // 每隔5秒定时打印日志：在线client，在线server
 func (service *TCPProxySessionService) periodicalPrint() {
 	log.Println("Starting proxy service periodical print")
 
-	ticker := time.NewTicker(service.conf.PrintInterval)
+	ticker := time.NewTicker(config.GetConfig().PrintInterval)
 	for {
 		select {
 		case <-service.stopChan:
 			log.Println("Stopped proxy service periodical print")
 			return
 		case <-ticker.C:
-			service.lock.RLock()
-			sessions := service.proxySessions
-			service.lock.RUnlock()
+			clients := service.onlineClients()
 
-			clients := make([]string, 0)
-			for client := range sessions {
-				clients = append(clients, client)
+			// The clients of an udp group are its flows
+			conf := service.getConf()
+			kind := "sessions"
+			if conf.Type == config.GROUPUDP {
+				kind = "flows"
 			}
-			sort.Strings(clients)
 
 			servers := service.disc.GetAllAliveRemoteAddresses()
-			log.Printf("在线clients: %v, 在线servers: %v", clients, servers)
+			log.Printf("group: %s, %s: %d, 在线clients: %v, 在线servers: %v", conf.Name, kind, len(clients), clients, servers)
 		}
 	}
 }
 
+// onlineClients returns the client addresses of the sessions in ascending order, the clients of a unix socket
+// have no address and are told apart by their sessions
+func (service *TCPProxySessionService) onlineClients() []string {
+	service.lock.RLock()
+	clients := make([]string, 0, len(service.proxySessions))
+	for id, clientProxySession := range service.proxySessions {
+		addr := clientProxySession.clientAddr()
+		if _, ok := addr.(*net.UnixAddr); ok {
+			clients = append(clients, "unix:"+id)
+			continue
+		}
+		clients = append(clients, addr.String())
+	}
+	service.lock.RUnlock()
+
+	sort.Strings(clients)
+	return clients
+}
+
+// handleConn checks the acl of the group before the session is created, the PROXY header is accepted
+// first so the acl sees the real client address
 func (service *TCPProxySessionService) handleConn(conn net.Conn) {
-	clientProxySession := service.add(conn)
-	defer service.close(clientProxySession)
+	conf := service.getConf()
+	var header *proxyHeader
+	var headerErr error
+	if conf.AcceptProxy != "" {
+		pc := newPeekConn(conn)
+		conn = pc
+		header, headerErr = acceptProxyHeader(pc, conf)
 
-	for {
-		clientProxySession.SetDeadline(time.Now().Add(service.conf.RWTimeout))
-		buffer := make([]byte, service.conf.HandleBuffer)
-		n, err := clientProxySession.Read(buffer)
-		if err == io.EOF {
-			// log.Println("Successfully read the client data, address:", clientProxySession.RemoteAddr())
+		select {
+		case <-service.stopChan:
+			// The group stopped accepting while the header was read, the drain does not wait for it
+			conn.Close()
 			return
+		default:
 		}
-
-		if err != nil {
-			log.Printf("Error to read client tcp package: %v\n", err)
+	}
+	if headerErr == nil {
+		addr := sourceAddr(conn, header)
+		if !service.allowed(addr, conf) {
+			conn.Close()
 			return
 		}
-		log.Printf("Successfully reading tcp package to proxy service, address: %v, package: %v\n", clientProxySession.RemoteAddr(), buffer[:n])
 
-		var tcpPackage TCPPackage
-		if err = json.Unmarshal(buffer[:n], &tcpPackage); err != nil {
-			go service.handleReverseProxyPackage(clientProxySession, buffer[:n])
-			continue
+		// Only an admitted connection becomes a session, the slot is released once the session is closed
+		if conf.Limits.Enabled() {
+			ip, ok := service.admit(addr, conf)
+			if !ok {
+				conn.Close()
+				return
+			}
+			defer service.limiter.release(ip)
 		}
+	}
 
-		switch tcpPackage.Type {
-		case HEARTBEAT:
-			go service.handleKeepAlivePackage(string(tcpPackage.Content))
-		case GETALLALIVESERVERS:
-			go service.handleGetAllAliveRemoteAddressesPackage(clientProxySession)
-		case STOPLISTEN:
-			go service.handleStopListenPackage()
-		default:
-			go service.handleReverseProxyPackage(clientProxySession, buffer[:n])
-		}
+	clientProxySession := service.add(conn, conf, header)
+	defer func() {
+		service.close(clientProxySession)
+		service.logAccess(clientProxySession)
+	}()
+
+	if headerErr != nil {
+		log.Printf("%s, clientAddr: %s\n", headerErr, conn.RemoteAddr())
+		clientProxySession.reason = REASONPROXYERROR
+		return
 	}
+	service.handleReverseProxyPackage(clientProxySession)
 }
 
-func (service *TCPProxySessionService) add(conn net.Conn) *TCPProxySession {
+func (service *TCPProxySessionService) add(conn net.Conn, conf config.GroupConfig, header *proxyHeader) *TCPProxySession {
 	service.lock.Lock()
 	defer service.lock.Unlock()
 
-	clientProxySession := &TCPProxySession{conn}
-	service.proxySessions[clientProxySession.RemoteAddr().String()] = clientProxySession
+	clientProxySession := &TCPProxySession{Conn: conn, conf: conf, accepted: time.Now(), id: newSessionID(), proxyHeader: header}
+	if needsPeek(clientProxySession.conf) {
+		clientProxySession.Conn = newPeekConn(conn)
+	}
+	clientProxySession.touch()
+	service.proxySessions[clientProxySession.id] = clientProxySession
+	metrics.SessionsAccepted.Inc(clientProxySession.conf.Name)
 	return clientProxySession
 }
 
@@ -169,102 +455,333 @@ func (service *TCPProxySessionService) close(clientProxySession *TCPProxySession
 	service.lock.Lock()
 	defer service.lock.Unlock()
 
-	address := clientProxySession.RemoteAddr().String()
-	delete(service.proxySessions, address)
-	log.Println("Close the client connection, address:", address)
+	// A session force closed by the drain is closed again by its own goroutine
+	if current, ok := service.proxySessions[clientProxySession.id]; ok && current == clientProxySession {
+		delete(service.proxySessions, clientProxySession.id)
+		metrics.SessionsClosed.Inc(clientProxySession.conf.Name)
+		metrics.SessionDuration.Observe(time.Since(clientProxySession.accepted).Seconds(), clientProxySession.conf.Name, clientProxySession.address)
+	}
 	return clientProxySession.Close()
 }
 
-func (service *TCPProxySessionService) handleReverseProxyPackage(clientProxySession *TCPProxySession, data []byte) {
-	// log.Println("handle reverse proxy package from remote address:", clientProxySession.RemoteAddr())
+// handleReverseProxyPackage picks the backend once for the session,
+// then copies bytes in both directions until either side closes
+func (service *TCPProxySessionService) handleReverseProxyPackage(clientProxySession *TCPProxySession) {
+	pool := service.route(clientProxySession)
+	clientProxySession.pool = pool.name
 
-	policyStatus := lb.PolicyNames[service.conf.LBPolicy]
-	lbPolicy, err := service.lbFactory.GetLBPolicy(policyStatus)
+	if tlsConfig := service.getTLSConfig(); tlsConfig != nil {
+		if err := service.terminateTLS(clientProxySession, tlsConfig); err != nil {
+			log.Println(err)
+			clientProxySession.reason = REASONTLSERROR
+			return
+		}
+	}
+
+	policyStatus := lb.PolicyNames[clientProxySession.conf.LBPolicy]
+	lbPolicy, err := pool.lbFactory.GetLBPolicy(policyStatus)
 	if err != nil {
 		log.Printf("Error to get load balance policy, status: %s, error:%s\n", policyStatus, err)
+		clientProxySession.reason = REASONDIALERROR
 		return
 	}
 
-	address := lbPolicy.GetAddress(clientProxySession.RemoteAddr().String(), service.disc.GetAllAliveRemoteAddresses())
-	serverConn, err := net.Dial("tcp", address)
+	// The latency aware policies learn from every dial and every first byte
+	feedback, _ := lbPolicy.(lb.IFeedbackPolicy)
+
+	serverConn, address, err := service.dialBackend(clientProxySession, pool.disc, lbPolicy)
 	if err != nil {
-		log.Printf("Error to dial connects to the remote address: %s, error: %s\n", address, err)
+		log.Println(err)
+		clientProxySession.reason = REASONDIALERROR
 		return
 	}
-	log.Printf("Create a server connetion, clientAddr: %s, proxyAddr: %s, remoteAddr: %s\n", clientProxySession.RemoteAddr(), serverConn.LocalAddr(), address)
-	defer func() {
-		serverConn.Close()
-		log.Println("Close a server connetion, address:", address)
-	}()
+	defer service.releaseBackend(address)
+
+	defer serverConn.Close()
 
-	errc := make(chan error)
-	go service.sendPackageToRemoteServer(clientProxySession, serverConn, data, errc)
-	go service.readPackageFromRemoteServer(clientProxySession, serverConn, errc)
+	// The drain closes the session from its own goroutine and reads the backend address
+	service.lock.Lock()
+	clientProxySession.serverConn, clientProxySession.address = serverConn, address
+	service.lock.Unlock()
+	clientProxySession.touch()
+
+	// The first byte latency starts at the first client byte, or at the connect for the server-first protocols
+	requestAt := int64(0)
+	connectedAt := time.Now().UnixNano()
+	onRequest := func() { atomic.CompareAndSwapInt64(&requestAt, 0, time.Now().UnixNano()) }
+	onResponse := func() {
+		if feedback == nil {
+			return
+		}
+
+		start := atomic.LoadInt64(&requestAt)
+		if start == 0 {
+			start = connectedAt
+		}
+		feedback.ObserveFirstByte(address, time.Since(time.Unix(0, start)))
+	}
+
+	errc := make(chan *pipeError, 2)
+	go service.pipe(clientProxySession, serverConn, clientProxySession.Conn, onRequest, errc)
+	go service.pipe(clientProxySession, clientProxySession.Conn, serverConn, onResponse, errc)
 
 	exit := <-errc
-	switch exit {
-	case io.EOF:
-	default:
+	if exit.err != io.EOF {
 		log.Println(exit)
 	}
+
+	// Closing both sides unblocks the other direction
+	clientProxySession.Conn.Close()
+	serverConn.Close()
+	<-errc
+
+	// Only the first error tells the failing side, the other one is caused by the closing
+	clientProxySession.reason = exit.reason(serverConn)
+	var serverErr error
+	if clientProxySession.reason == REASONBACKENDERROR {
+		serverErr = exit
+	}
+	// A trial connection is reported once it is connected, the io failures of the session count like any other
+	pool.disc.ReportResult(address, false, serverErr)
 }
 
-func (service *TCPProxySessionService) sendPackageToRemoteServer(clientProxySession *TCPProxySession, serverConn net.Conn, data []byte, errc chan error) {
-	serverConn.SetDeadline(time.Now().Add(service.conf.RWTimeout))
+// pipeError an io failure or the EOF of the proxied connection conn
+type pipeError struct {
+	conn net.Conn
+	err  error
+	msg  string
+}
+
+func (e *pipeError) Error() string {
+	return e.msg
+}
 
-	if _, err := serverConn.Write(data); err != nil {
-		errc <- fmt.Errorf("Error to write client data to remote server, error: %s", err)
+// reason returns the termination reason of the session
+func (e *pipeError) reason(serverConn net.Conn) string {
+	netErr, ok := e.err.(net.Error)
+	switch {
+	case ok && netErr.Timeout():
+		return REASONTIMEOUT
+	case e.err == io.EOF && e.conn == serverConn:
+		return REASONBACKENDEOF
+	case e.err == io.EOF:
+		return REASONCLIENTEOF
+	case e.conn == serverConn:
+		return REASONBACKENDERROR
 	}
+	return REASONCLIENTERROR
 }
 
-func (service *TCPProxySessionService) readPackageFromRemoteServer(clientProxySession *TCPProxySession, serverConn net.Conn, errc chan error) {
-	for {
-		serverConn.SetDeadline(time.Now().Add(service.conf.RWTimeout))
+// dialBackend connects to the remote address of the pool picked by the lb policy. Before any client byte is forwarded,
+// a failed dial is retried on the remote addresses not tried yet within the retry budget of the group,
+// and all the attempts are logged as one event. The connected address is acquired for the caller to release,
+// a half-open trial closes the circuit breaker as soon as it is connected so a long session does not hold the trial
+func (service *TCPProxySessionService) dialBackend(clientProxySession *TCPProxySession, disc *discovery.Service, lbPolicy lb.IBalancePolicy) (net.Conn, string, error) {
+	conf := clientProxySession.conf
+	feedback, _ := lbPolicy.(lb.IFeedbackPolicy)
+	key := service.hashKey(clientProxySession)
+	backendTLS := service.getBackendTLSConfig()
+
+	retries := conf.Retries
+	if retries < 0 {
+		retries = 0
+	}
 
-		buffer := make([]byte, 1024)
-		n, err := serverConn.Read(buffer)
-		if err == io.EOF {
-			errc <- io.EOF
-			return
+	tried := make(map[string]struct{})
+	attempts := make([]string, 0)
+	for attempt := 0; attempt <= retries; attempt++ {
+		// The policies always get the whole list, their state such as the hash ring or the current weights
+		// belongs to it. A tried address is skipped after the pick
+		addresses := disc.GetAllAliveRemoteAddresses()
+		address := lbPolicy.GetAddress(key, addresses)
+		if _, ok := tried[address]; ok {
+			address = nextUntried(addresses, address, tried)
+		}
+		if address == "" {
+			break
 		}
+		tried[address] = struct{}{}
 
-		if err != nil {
-			errc <- fmt.Errorf("Error to read tcp package from remote server, error: %s", err)
-			return
+		trial, ok := disc.Admit(address)
+		if !ok {
+			attempts = append(attempts, fmt.Sprintf("%s: ejected", address))
+			continue
 		}
 
-		clientProxySession.SetDeadline(time.Now().Add(service.conf.RWTimeout))
-		if _, err = clientProxySession.Write(buffer[:n]); err != nil {
-			errc <- fmt.Errorf("Error to write tcp package to client, error: %s", err)
-			return
+		service.acquireBackend(address)
+		dialStart := time.Now()
+		serverConn, err := service.connectBackend(clientProxySession, address, backendTLS)
+		if err == nil {
+			metrics.DialDuration.Observe(time.Since(dialStart).Seconds(), conf.Name, address)
+			if feedback != nil {
+				feedback.ObserveConnect(address, time.Since(dialStart))
+			}
+			if trial {
+				disc.ReportResult(address, true, nil)
+			}
+			if len(attempts) > 0 {
+				log.Printf("Retried to connect to the remote address: %s, client: %s, failed attempts: [%s]\n", address, clientProxySession.clientAddr(), strings.Join(attempts, ", "))
+			}
+			return serverConn, address, nil
+		}
+
+		metrics.DialErrors.Inc(conf.Name, address)
+		if feedback != nil {
+			feedback.ObserveConnect(address, conf.RWTimeout)
 		}
+		service.releaseBackend(address)
+		disc.ReportResult(address, trial, err)
+		attempts = append(attempts, fmt.Sprintf("%s: %s", address, err))
+	}
+
+	if len(attempts) == 0 {
+		return nil, "", fmt.Errorf("Error to dial connects to the remote address, client: %s, error: no alive remote address", clientProxySession.clientAddr())
 	}
+	return nil, "", fmt.Errorf("Error to dial connects to the remote address, client: %s, attempts: [%s]", clientProxySession.clientAddr(), strings.Join(attempts, ", "))
 }
 
-func (service *TCPProxySessionService) handleKeepAlivePackage(address string) {
-	// log.Println("Receive a keep alive package from remote address:", address)
+// nextUntried returns the first address following the picked one in the list which is not tried yet,
+// the list is walked in a circle. It returns empty when every address is tried
+func nextUntried(addresses []string, picked string, tried map[string]struct{}) string {
+	start := 0
+	for i, address := range addresses {
+		if address == picked {
+			start = i
+			break
+		}
+	}
 
-	service.disc.HandleAliveMessage(address)
+	for i := 1; i <= len(addresses); i++ {
+		address := addresses[(start+i)%len(addresses)]
+		if _, ok := tried[address]; !ok {
+			return address
+		}
+	}
+	return ""
 }
 
-func (service *TCPProxySessionService) handleGetAllAliveRemoteAddressesPackage(clientProxySession *TCPProxySession) {
-	// log.Println("Receive a get all alive remote server addresses package")
+// connectBackend dials the remote address and gets it ready for the client bytes: the PROXY header is
+// written first, then the TLS handshake is done when the group dials its backends over TLS
+func (service *TCPProxySessionService) connectBackend(clientProxySession *TCPProxySession, address string, backendTLS *tls.Config) (net.Conn, error) {
+	conf := clientProxySession.conf
+	network, dialAddress := config.SplitNetwork(conf.Type, address)
+	serverConn, err := net.DialTimeout(network, dialAddress, conf.RWTimeout)
+	if err != nil {
+		return nil, err
+	}
 
-	addresses := service.disc.GetAllAliveRemoteAddresses()
-	data, err := json.Marshal(addresses)
+	if err = service.sendProxyHeader(clientProxySession, serverConn); err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+
+	if backendTLS == nil {
+		return serverConn, nil
+	}
+
+	tlsConn, err := originateTLS(serverConn, address, backendTLS, conf.RWTimeout)
 	if err != nil {
-		log.Printf("Error to marshal all alive remote server addresses to []byte, addresses: %v, error: %v\n", addresses, err)
-		return
+		serverConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialProbe connects the health probes the way connectBackend connects the sessions: a PROXY header
+// without addresses, the LOCAL command of v2, is written first and then the TLS handshake is done
+func (service *TCPProxySessionService) dialProbe(address string, timeout time.Duration) (net.Conn, error) {
+	network, dialAddress := config.SplitNetwork("tcp", address)
+	serverConn, err := net.DialTimeout(network, dialAddress, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var header []byte
+	switch service.getConf().SendProxy {
+	case config.PROXYV1:
+		header = newProxyV1Header(nil, nil)
+	case config.PROXYV2:
+		header = newProxyV2Header(nil, nil, nil)
+	}
+	if header != nil {
+		serverConn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err = serverConn.Write(header); err != nil {
+			serverConn.Close()
+			return nil, err
+		}
+		serverConn.SetWriteDeadline(time.Time{})
 	}
 
-	if _, err = clientProxySession.Write(data); err != nil {
-		log.Printf("Error to write all alive remote addresses to client, address: %v, addresses: %v\n", clientProxySession.RemoteAddr(), addresses)
+	backendTLS := service.getBackendTLSConfig()
+	if backendTLS == nil {
+		return serverConn, nil
 	}
+
+	tlsConn, err := originateTLS(serverConn, address, backendTLS, timeout)
+	if err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
-func (service *TCPProxySessionService) handleStopListenPackage() {
-	log.Println("Stopping proxy service")
-	defer log.Println("Stopped proxy service")
+// pipe copies bytes from src to dst until src is closed or the whole session is idle for RWTimeout,
+// onFirstRead is called once when the first bytes arrive from src
+func (service *TCPProxySessionService) pipe(clientProxySession *TCPProxySession, dst, src net.Conn, onFirstRead func(), errc chan *pipeError) {
+	conf := clientProxySession.conf
+	bytes, counter := metrics.BytesOut, &clientProxySession.bytesOut
+	if src == clientProxySession.Conn {
+		bytes, counter = metrics.BytesIn, &clientProxySession.bytesIn
+	}
+	// The address is set before the pipes are started, the counter is resolved once for every chunk
+	backendBytes := bytes.With(conf.Name, clientProxySession.address)
+
+	size := conf.HandleBuffer
+	if conf.Type == config.GROUPUDP && size < UDPBUFFERSIZE {
+		size = UDPBUFFERSIZE
+	}
+
+	buffer := make([]byte, size)
+	for {
+		src.SetReadDeadline(time.Now().Add(conf.RWTimeout))
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if onFirstRead != nil {
+				onFirstRead()
+				onFirstRead = nil
+			}
+
+			clientProxySession.touch()
+			dst.SetWriteDeadline(time.Now().Add(conf.RWTimeout))
+			backendBytes.Add(float64(n))
+			atomic.AddInt64(counter, int64(n))
+			if _, werr := dst.Write(buffer[:n]); werr != nil {
+				errc <- &pipeError{conn: dst, err: werr, msg: fmt.Sprintf("Error to write tcp package to %s, error: %s", dst.RemoteAddr(), werr)}
+				return
+			}
+		}
+
+		if err == io.EOF {
+			errc <- &pipeError{conn: src, err: err, msg: fmt.Sprintf("EOF from %s", src.RemoteAddr())}
+			return
+		}
+
+		// The other direction may still be busy, only an idle session times out
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && clientProxySession.idle() < conf.RWTimeout {
+			continue
+		}
+
+		if err != nil {
+			errc <- &pipeError{conn: src, err: err, msg: fmt.Sprintf("Error to read tcp package from %s, error: %s", src.RemoteAddr(), err)}
+			return
+		}
+	}
+}
+
+// stopAccepting closes the listener, the running sessions are left to drain until the drain deadline of the group
+func (service *TCPProxySessionService) stopAccepting() {
+	conf := service.getConf()
+	log.Println("Stopping proxy service, group:", conf.Name)
 
 	close(service.stopChan)
 
@@ -273,10 +790,60 @@ func (service *TCPProxySessionService) handleStopListenPackage() {
 		log.Println("Error to close proxy service lisener, error:", err)
 	}
 
+	service.lock.Lock()
+	service.drainDeadline = time.Now().Add(conf.DrainTimeout)
+	service.lock.Unlock()
+}
+
+// drain waits for the running sessions to finish, the sessions left at the drain deadline are closed
+func (service *TCPProxySessionService) drain() {
+	name := service.getConf().Name
+	defer log.Println("Stopped proxy service, group:", name)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var logged time.Time
+	for {
+		status := service.drainStatus()
+		if status.Sessions == 0 || !time.Now().Before(status.Deadline) {
+			break
+		}
+
+		if time.Since(logged) >= time.Second {
+			logged = time.Now()
+			log.Printf("Draining proxy service, group: %s, sessions: %d, force close in %s\n", name, status.Sessions, time.Until(status.Deadline).Round(time.Millisecond))
+		}
+		<-ticker.C
+	}
+
+	service.lock.RLock()
+	sessions := make([]*TCPProxySession, 0, len(service.proxySessions))
 	for _, clientProxySession := range service.proxySessions {
-		if err = service.close(clientProxySession); err != nil {
+		sessions = append(sessions, clientProxySession)
+	}
+	service.lock.RUnlock()
+
+	if len(sessions) > 0 {
+		log.Printf("Drain deadline reached, group: %s, force closing sessions: %d\n", name, len(sessions))
+	}
+	for _, clientProxySession := range sessions {
+		atomic.StoreInt32(&clientProxySession.killed, 1)
+		if err := service.close(clientProxySession); err != nil {
 			log.Println("Error to close client proxy session, error:", err)
 		}
 	}
+}
+
+// DrainStatus the progress of a closing group
+type DrainStatus struct {
+	Sessions int       `json:"sessions"` // sessions still running
+	Deadline time.Time `json:"deadline"` // the running sessions are closed at the deadline
+}
+
+func (service *TCPProxySessionService) drainStatus() DrainStatus {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
 
+	return DrainStatus{Sessions: len(service.proxySessions), Deadline: service.drainDeadline}
 }
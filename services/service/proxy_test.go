@@ -9,27 +9,32 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/discovery"
+	"github.com/wangff15386/goproxy/services/lb"
 )
 
 func Test_TCPProxySessionService(t *testing.T) {
 	tcpPort := "11101"
-	assert.NotPanics(t, func() { go StartService(tcpPort) })
+	assert.NoError(t, OpenGroup(tcpPort))
 
-	remoteAddress := "127.0.0.1:11122"
+	remoteAddress := "127.0.0.1:11123"
 	go startRemoteForTests(remoteAddress)
 
 	stopChan := make(chan struct{})
 
+	time.Sleep(200 * time.Millisecond)
+
 	//发送心跳的goroutine
 	go func() {
-		err := SendKeepAlivePackage(tcpPort, remoteAddress)
+		err := KeepAlive(tcpPort, "", remoteAddress, 0)
 		assert.NoError(t, err)
 
 		heartBeatTick := time.NewTicker(2 * time.Second)
 		for {
 			select {
 			case <-heartBeatTick.C:
-				SendKeepAlivePackage(tcpPort, remoteAddress)
+				KeepAlive(tcpPort, "", remoteAddress, 0)
 			case <-stopChan:
 				return
 			}
@@ -79,6 +84,302 @@ func Test_TCPProxySessionService(t *testing.T) {
 	<-stopChan
 }
 
+func Test_TCPProxySessionStream(t *testing.T) {
+	tcpPort := "11102"
+	assert.NoError(t, OpenGroup(tcpPort))
+	defer stopListenForTests(tcpPort)
+
+	remoteAddress := "127.0.0.1:11124"
+	accepted := make(chan struct{}, 10)
+	go startEchoRemoteForTests(remoteAddress, accepted)
+
+	time.Sleep(200 * time.Millisecond)
+	err := KeepAlive(tcpPort, "", remoteAddress, 0)
+	assert.NoError(t, err)
+
+	clientConn, err := net.Dial("tcp", fmt.Sprintf("localhost:%s", tcpPort))
+	assert.NoError(t, err)
+	defer clientConn.Close()
+
+	// Every chunk must be echoed through the same backend connection
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("chunk-%d", i))
+		_, err = clientConn.Write(data)
+		assert.NoError(t, err)
+
+		buffer := make([]byte, 1024)
+		clientConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := clientConn.Read(buffer)
+		assert.NoError(t, err)
+		assert.Equal(t, data, buffer[:n])
+	}
+	assert.Equal(t, 1, len(accepted))
+
+	// the session is counted on its backend until it closes
+	connections, err := GetAllConnections(tcpPort)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{remoteAddress: 1}, connections)
+
+	clientConn.Close()
+	time.Sleep(200 * time.Millisecond)
+	connections, err = GetAllConnections(tcpPort)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{remoteAddress: 0}, connections)
+}
+
+func Test_StartServiceWithStaticServers(t *testing.T) {
+	remoteAddress := "127.0.0.1:11125"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11103")
+	groupConf.Name = "static-tests"
+	groupConf.HandleBuffer = 16
+	groupConf.Servers = []string{remoteAddress}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+
+	conf, err := GetGroupConfig(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, groupConf, conf)
+	assert.Contains(t, GetAllGroups(), groupConf.Name)
+
+	// The static servers are selectable without any heartbeat
+	time.Sleep(200 * time.Millisecond)
+	clientConn, err := net.Dial("tcp", "localhost:11103")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+
+	data := []byte("bigger than the handle buffer of the group")
+	_, err = clientConn.Write(data)
+	assert.NoError(t, err)
+
+	received := make([]byte, len(data))
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(clientConn, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+func Test_OutlierDetection(t *testing.T) {
+	remoteAddress := "127.0.0.1:11129"
+
+	groupConf := config.GetConfig().NewGroupConfig("11106")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.OutlierDetection = config.OutlierDetectionConfig{ConsecutiveFailures: 2, BaseEjectionTime: 300 * time.Millisecond, MaxEjectionTime: time.Second, HalfOpenTrials: 1}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// Every dial to the dead server fails and drops the client
+	for i := 0; i < 2; i++ {
+		clientConn, err := net.Dial("tcp", "localhost:11106")
+		assert.NoError(t, err)
+		clientConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = clientConn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		clientConn.Close()
+	}
+
+	outliers, err := GetAllOutliers(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, discovery.OUTLIEREJECTED, outliers[remoteAddress].State)
+	assert.Equal(t, 1, outliers[remoteAddress].Ejections)
+	list, err := GetAllAliveServerAddresses(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+
+	// After the ejection a trial connection closes the circuit breaker again
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+	time.Sleep(400 * time.Millisecond)
+	outliers, err = GetAllOutliers(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, discovery.OUTLIERHALFOPEN, outliers[remoteAddress].State)
+
+	// the trial is reported once connected, the session held open does not keep the breaker half-open
+	clientConn, err := net.Dial("tcp", "localhost:11106")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	echoForTests(t, clientConn, "ping")
+
+	outliers, err = GetAllOutliers(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, discovery.OutlierStatus{State: discovery.OUTLIERCLOSED}, outliers[remoteAddress])
+	list, err = GetAllAliveServerAddresses(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{remoteAddress}, list)
+
+	next, err := net.Dial("tcp", "localhost:11106")
+	assert.NoError(t, err)
+	defer next.Close()
+	echoForTests(t, next, "pong")
+}
+
+func Test_DialRetry(t *testing.T) {
+	deadAddress, remoteAddress := "127.0.0.1:11130", "127.0.0.1:11131"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11112")
+	groupConf.LBPolicy = int(lb.HA)
+	groupConf.Servers = []string{deadAddress, remoteAddress}
+	policy := &recordingPolicyForTests{IBalancePolicy: &lb.Ha{}, lists: make(chan []string, 10)}
+	assert.NoError(t, startService(groupConf, lb.WithPolicy(lb.HA, policy)))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// ha always picks the dead server first, the retry reaches the other one
+	clientConn, err := net.Dial("tcp", "localhost:11112")
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "ping")
+	clientConn.Close()
+
+	// the policy sees every alive server on the retry too, the tried one is skipped after the pick
+	assert.Equal(t, 2, len(policy.lists))
+	for len(policy.lists) > 0 {
+		assert.Equal(t, groupConf.Servers, <-policy.lists)
+	}
+
+	// without any retry budget the client is dropped
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	groupConf.Retries = -1
+	service.reconfigure(groupConf)
+
+	clientConn, err = net.Dial("tcp", "localhost:11112")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// recordingPolicyForTests records the lists the policy picks from
+type recordingPolicyForTests struct {
+	lb.IBalancePolicy
+	lists chan []string
+}
+
+func (p *recordingPolicyForTests) GetAddress(localAddress string, remoteAddresses []string) string {
+	p.lists <- append([]string(nil), remoteAddresses...)
+	return p.IBalancePolicy.GetAddress(localAddress, remoteAddresses)
+}
+
+func Test_NextUntried(t *testing.T) {
+	addresses := []string{"a", "b", "c"}
+	assert.Equal(t, "c", nextUntried(addresses, "b", map[string]struct{}{"b": {}}))
+	assert.Equal(t, "a", nextUntried(addresses, "b", map[string]struct{}{"b": {}, "c": {}}))
+	assert.Equal(t, "", nextUntried(addresses, "b", map[string]struct{}{"a": {}, "b": {}, "c": {}}))
+}
+
+type feedbackForTests struct {
+	lb.IBalancePolicy
+	connects   chan time.Duration
+	firstBytes chan time.Duration
+}
+
+func (f *feedbackForTests) ObserveConnect(address string, latency time.Duration) {
+	f.connects <- latency
+}
+
+func (f *feedbackForTests) ObserveFirstByte(address string, latency time.Duration) {
+	f.firstBytes <- latency
+}
+
+func Test_LatencyFeedback(t *testing.T) {
+	remoteAddress := "127.0.0.1:11128"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11110")
+	groupConf.LBPolicy = int(lb.LATENCYEWMA)
+	groupConf.Servers = []string{remoteAddress}
+	// the policy is replaced before the group accepts any session
+	feedback := &feedbackForTests{lb.NewEWMA(nil), make(chan time.Duration, 10), make(chan time.Duration, 10)}
+	assert.NoError(t, startService(groupConf, lb.WithPolicy(lb.LATENCYEWMA, feedback)))
+	defer stopListenForTests(groupConf.Name)
+
+	time.Sleep(200 * time.Millisecond)
+	clientConn, err := net.Dial("tcp", "localhost:11110")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	echoForTests(t, clientConn, "ping")
+	echoForTests(t, clientConn, "ping")
+
+	// one connect and one first byte per session, the first byte doesn't include the client think time
+	assert.Equal(t, 1, len(feedback.connects))
+	assert.Equal(t, 1, len(feedback.firstBytes))
+	assert.True(t, <-feedback.firstBytes < 100*time.Millisecond)
+}
+
+func Test_BindHost(t *testing.T) {
+	go startEchoRemoteForTests("[::1]:11151", make(chan struct{}, 100))
+	go startEchoRemoteForTests("[::1]:11154", make(chan struct{}, 100))
+
+	groupConf := config.GetConfig().NewGroupConfig("11152")
+	groupConf.Bind = "::1"
+	groupConf.Servers = []string{"[::1]:11151"}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+
+	wildcard := config.GetConfig().NewGroupConfig("11153")
+	wildcard.Bind = config.BINDANY
+	wildcard.Servers = []string{"[::1]:11151"}
+	assert.NoError(t, StartService(wildcard))
+	defer stopListenForTests(wildcard.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// the ipv6 workers register and are picked by every lb policy
+	assert.NoError(t, KeepAlive(groupConf.Name, "", "[::1]:11154", 0))
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	for policy := range lb.PolicyNames {
+		if policy == int(lb.UNKNOWN) {
+			continue
+		}
+		groupConf.LBPolicy = policy
+		service.reconfigure(groupConf)
+
+		clientConn, err := net.Dial("tcp", "[::1]:11152")
+		assert.NoError(t, err)
+		echoForTests(t, clientConn, fmt.Sprintf("policy %d", policy))
+		clientConn.Close()
+	}
+
+	// the ipv6 loopback is not reachable over ipv4
+	_, err = net.Dial("tcp", "127.0.0.1:11152")
+	assert.Error(t, err)
+
+	// the wildcard listens on both
+	for _, address := range []string{"127.0.0.1:11153", "[::1]:11153"} {
+		clientConn, err := net.Dial("tcp", address)
+		assert.NoError(t, err)
+		echoForTests(t, clientConn, address)
+		clientConn.Close()
+	}
+}
+
+func startEchoRemoteForTests(address string, accepted chan struct{}) {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Panicf("Error to listen tcp service, address: %s, err: %s", address, err)
+	}
+	defer lis.Close()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Printf("Error to establish connection :%v\n", err)
+			return
+		}
+		accepted <- struct{}{}
+
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
 func startRemoteForTests(address string) {
 	lis, err := net.Listen("tcp", address)
 	if err != nil {
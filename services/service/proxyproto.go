@@ -0,0 +1,284 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangff15386/goproxy/config"
+)
+
+// The signatures of the PROXY protocol, see https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// PROXYV1MAXLENGTH the longest PROXY v1 header including the CRLF
+const PROXYV1MAXLENGTH = 107
+
+// The PROXY v2 TLV types set by the proxy
+const (
+	PP2TYPEUNIQUEID = 0x05 // the session id of the access log
+)
+
+// proxyHeader a PROXY protocol header sent by the load balancer in front of the proxy
+type proxyHeader struct {
+	version         int
+	sourceAddr      net.Addr // nil for the LOCAL command and the UNKNOWN protocol
+	destinationAddr net.Addr
+	tlvs            []proxyTLV // v2 only
+	length          int        // bytes of the header on the wire
+}
+
+// proxyTLV a type-length-value extension of the PROXY v2 header
+type proxyTLV struct {
+	typ   byte
+	value []byte
+}
+
+// peekProxyHeader parses the PROXY v1 or v2 header at the start of the stream without consuming it,
+// it returns nil when the stream doesn't start with a PROXY header
+func peekProxyHeader(reader *bufio.Reader) (*proxyHeader, error) {
+	if data, _ := reader.Peek(1); len(data) == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case peekPrefix(reader, proxyV1Signature):
+		return peekProxyV1Header(reader)
+	case peekPrefix(reader, proxyV2Signature):
+		return peekProxyV2Header(reader)
+	default:
+		return nil, nil
+	}
+}
+
+func peekProxyV1Header(reader *bufio.Reader) (*proxyHeader, error) {
+	var line []byte
+	for n := len(proxyV1Signature) + 1; ; n++ {
+		data, err := reader.Peek(n)
+		if err != nil {
+			return nil, fmt.Errorf("Error to read PROXY v1 header, error: %s", err)
+		}
+		if bytes.HasSuffix(data, []byte("\r\n")) {
+			line = data
+			break
+		}
+		if n >= PROXYV1MAXLENGTH {
+			return nil, fmt.Errorf("Error to read PROXY v1 header, no CRLF in %d bytes", PROXYV1MAXLENGTH)
+		}
+	}
+
+	header := &proxyHeader{version: 1, length: len(line)}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Error to parse PROXY v1 header %q", line)
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, fmt.Errorf("Error to parse PROXY v1 header %q", line)
+	}
+
+	header.sourceAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	header.destinationAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return header, nil
+}
+
+func peekProxyV2Header(reader *bufio.Reader) (*proxyHeader, error) {
+	data, err := reader.Peek(16)
+	if err != nil {
+		return nil, fmt.Errorf("Error to read PROXY v2 header, error: %s", err)
+	}
+
+	versionCommand, family := data[12], data[13]
+	length := 16 + int(binary.BigEndian.Uint16(data[14:16]))
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("Error to parse PROXY v2 header, unknown version %d", versionCommand>>4)
+	}
+
+	if data, err = reader.Peek(length); err != nil {
+		return nil, fmt.Errorf("Error to read PROXY v2 header, error: %s", err)
+	}
+
+	header := &proxyHeader{version: 2, length: length}
+	// The LOCAL command carries no addresses, the connection comes from the load balancer itself
+	if versionCommand&0x0F == 0 {
+		return header, nil
+	}
+
+	payload := data[16:]
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("Error to parse PROXY v2 header, short IPv4 addresses")
+		}
+		header.sourceAddr = newProxyAddr(family, payload[0:4], payload[8:10])
+		header.destinationAddr = newProxyAddr(family, payload[4:8], payload[10:12])
+		payload = payload[12:]
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("Error to parse PROXY v2 header, short IPv6 addresses")
+		}
+		header.sourceAddr = newProxyAddr(family, payload[0:16], payload[32:34])
+		header.destinationAddr = newProxyAddr(family, payload[16:32], payload[34:36])
+		payload = payload[36:]
+	case 3: // AF_UNIX, the addresses are not used
+		if len(payload) < 216 {
+			return nil, fmt.Errorf("Error to parse PROXY v2 header, short unix addresses")
+		}
+		payload = payload[216:]
+	default:
+		return header, nil
+	}
+
+	for len(payload) > 0 {
+		if len(payload) < 3 || len(payload) < 3+int(binary.BigEndian.Uint16(payload[1:3])) {
+			return nil, fmt.Errorf("Error to parse PROXY v2 header, short TLV")
+		}
+		end := 3 + int(binary.BigEndian.Uint16(payload[1:3]))
+		header.tlvs = append(header.tlvs, proxyTLV{typ: payload[0], value: append([]byte(nil), payload[3:end]...)})
+		payload = payload[end:]
+	}
+	return header, nil
+}
+
+func newProxyAddr(family byte, ip, port []byte) net.Addr {
+	addrIP := make(net.IP, len(ip))
+	copy(addrIP, ip)
+	addrPort := int(binary.BigEndian.Uint16(port))
+
+	if family&0x0F == 2 { // DGRAM
+		return &net.UDPAddr{IP: addrIP, Port: addrPort}
+	}
+	return &net.TCPAddr{IP: addrIP, Port: addrPort}
+}
+
+// newProxyV1Header formats the PROXY v1 header of the addresses, UNKNOWN when they are not TCP addresses
+func newProxyV1Header(sourceAddr, destinationAddr net.Addr) []byte {
+	src, srcOK := sourceAddr.(*net.TCPAddr)
+	dst, dstOK := destinationAddr.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyV1IPv6(src.IP), proxyV1IPv6(dst.IP), src.Port, dst.Port))
+}
+
+// proxyV1IPv6 formats an IPv4 address as IPv4-mapped IPv6, the way the TCP6 line requires
+func proxyV1IPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// newProxyV2Header encodes the PROXY v2 header of the addresses with the TLVs, the LOCAL command
+// when they are not TCP addresses
+func newProxyV2Header(sourceAddr, destinationAddr net.Addr, tlvs []proxyTLV) []byte {
+	var command, family byte = 0x20, 0x00 // LOCAL, UNSPEC
+	var addresses []byte
+
+	src, srcOK := sourceAddr.(*net.TCPAddr)
+	dst, dstOK := destinationAddr.(*net.TCPAddr)
+	if srcOK && dstOK {
+		command = 0x21 // PROXY
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+		binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+
+		if src.IP.To4() != nil && dst.IP.To4() != nil {
+			family = 0x11 // TCP over IPv4
+			addresses = append(append(append(addresses, src.IP.To4()...), dst.IP.To4()...), ports...)
+		} else {
+			family = 0x21 // TCP over IPv6
+			addresses = append(append(append(addresses, src.IP.To16()...), dst.IP.To16()...), ports...)
+		}
+	}
+
+	for _, tlv := range tlvs {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(tlv.value)))
+		addresses = append(append(append(addresses, tlv.typ), length...), tlv.value...)
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+	header = append(append(append(header, command, family), length...), addresses...)
+	return header
+}
+
+// acceptProxyHeader consumes the PROXY header the group requires from the load balancer in front of the proxy,
+// the source address in it becomes the client address of the session
+func acceptProxyHeader(pc *peekConn, conf config.GroupConfig) (*proxyHeader, error) {
+	pc.SetReadDeadline(time.Now().Add(conf.RWTimeout))
+	defer pc.SetReadDeadline(time.Time{})
+
+	header, err := peekProxyHeader(pc.reader)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("Error to accept PROXY header, the client sent none")
+	}
+	if conf.AcceptProxy != config.PROXYANY && conf.AcceptProxy != fmt.Sprintf("v%d", header.version) {
+		return nil, fmt.Errorf("Error to accept PROXY header, got v%d, want %s", header.version, conf.AcceptProxy)
+	}
+
+	if _, err = pc.reader.Discard(header.length); err != nil {
+		return nil, fmt.Errorf("Error to accept PROXY header, error: %s", err)
+	}
+	return header, nil
+}
+
+// sendProxyHeader writes the PROXY header of the session to the backend before any client byte and before the TLS handshake,
+// the v2 header carries the TLVs received from the load balancer and the session id
+func (service *TCPProxySessionService) sendProxyHeader(clientProxySession *TCPProxySession, serverConn net.Conn) error {
+	conf := clientProxySession.conf
+	sourceAddr, destinationAddr := clientProxySession.clientAddr(), clientProxySession.LocalAddr()
+	var tlvs []proxyTLV
+	if header := clientProxySession.proxyHeader; header != nil {
+		if header.destinationAddr != nil {
+			destinationAddr = header.destinationAddr
+		}
+		tlvs = append(tlvs, header.tlvs...)
+	}
+
+	var data []byte
+	switch conf.SendProxy {
+	case config.PROXYV1:
+		data = newProxyV1Header(sourceAddr, destinationAddr)
+	case config.PROXYV2:
+		hasID := false
+		for _, tlv := range tlvs {
+			hasID = hasID || tlv.typ == PP2TYPEUNIQUEID
+		}
+		if !hasID {
+			tlvs = append(tlvs, proxyTLV{typ: PP2TYPEUNIQUEID, value: []byte(clientProxySession.id)})
+		}
+		data = newProxyV2Header(sourceAddr, destinationAddr, tlvs)
+	default:
+		return nil
+	}
+
+	serverConn.SetWriteDeadline(time.Now().Add(conf.RWTimeout))
+	if _, err := serverConn.Write(data); err != nil {
+		return fmt.Errorf("Error to send PROXY header to %s, error: %s", serverConn.RemoteAddr(), err)
+	}
+	return nil
+}
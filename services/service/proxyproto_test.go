@@ -0,0 +1,179 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+func Test_PeekProxyHeaderV1(t *testing.T) {
+	data := "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"
+	reader := bufio.NewReader(bytes.NewBufferString(data))
+
+	header, err := peekProxyHeader(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, header.version)
+	assert.Equal(t, "192.168.0.1:56324", header.sourceAddr.String())
+	assert.Equal(t, "192.168.0.11:443", header.destinationAddr.String())
+	assert.Equal(t, 47, header.length)
+
+	// nothing is consumed
+	assert.Equal(t, len(data), reader.Buffered())
+
+	header, err = peekProxyHeader(bufio.NewReader(bytes.NewBufferString("PROXY TCP6 ::1 ::2 1 2\r\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:1", header.sourceAddr.String())
+
+	header, err = peekProxyHeader(bufio.NewReader(bytes.NewBufferString("PROXY UNKNOWN\r\n")))
+	assert.NoError(t, err)
+	assert.Nil(t, header.sourceAddr)
+
+	_, err = peekProxyHeader(bufio.NewReader(bytes.NewBufferString("PROXY TCP4 a b c d\r\n")))
+	assert.Error(t, err)
+}
+
+func Test_PeekProxyHeaderV2(t *testing.T) {
+	payload := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(payload[8:], 1234)
+	binary.BigEndian.PutUint16(payload[10:], 80)
+
+	data := append([]byte{}, proxyV2Signature...)
+	data = append(data, 0x21, 0x11, 0, byte(len(payload)))
+	data = append(data, payload...)
+	data = append(data, []byte("payload")...)
+
+	reader := bufio.NewReader(bytes.NewBuffer(data))
+	header, err := peekProxyHeader(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, header.version)
+	assert.Equal(t, "10.0.0.1:1234", header.sourceAddr.String())
+	assert.Equal(t, "10.0.0.2:80", header.destinationAddr.String())
+	assert.Equal(t, 28, header.length)
+	assert.Equal(t, len(data), reader.Buffered())
+
+	// LOCAL command
+	local := append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0, 0)
+	header, err = peekProxyHeader(bufio.NewReader(bytes.NewBuffer(local)))
+	assert.NoError(t, err)
+	assert.Nil(t, header.sourceAddr)
+}
+
+func Test_PeekProxyHeaderV2TLV(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}
+	tlvs := []proxyTLV{{typ: 0x01, value: []byte("h2")}, {typ: PP2TYPEUNIQUEID, value: []byte("0123456789abcdef")}}
+	data := newProxyV2Header(src, dst, tlvs)
+
+	header, err := peekProxyHeader(bufio.NewReader(bytes.NewBuffer(append(data, []byte("payload")...))))
+	assert.NoError(t, err)
+	assert.Equal(t, src.String(), header.sourceAddr.String())
+	assert.Equal(t, dst.String(), header.destinationAddr.String())
+	assert.Equal(t, tlvs, header.tlvs)
+	assert.Equal(t, len(data), header.length)
+
+	// a TLV longer than the header is broken
+	data[len(data)-17]++
+	_, err = peekProxyHeader(bufio.NewReader(bytes.NewBuffer(data)))
+	assert.Error(t, err)
+}
+
+func Test_NewProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	unix := &net.UnixAddr{Name: "/tmp/goproxy.sock", Net: "unix"}
+
+	assert.Equal(t, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", string(newProxyV1Header(src, dst)))
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 ::ffff:192.168.0.11 56324 443\r\n", string(newProxyV1Header(src6, dst)))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(newProxyV1Header(unix, dst)))
+
+	// every header is read back by the parser
+	for _, data := range [][]byte{newProxyV1Header(src6, dst), newProxyV2Header(src6, dst, nil)} {
+		header, err := peekProxyHeader(bufio.NewReader(bytes.NewBuffer(data)))
+		assert.NoError(t, err)
+		assert.Equal(t, "[2001:db8::1]:56324", header.sourceAddr.String())
+		assert.Equal(t, len(data), header.length)
+	}
+
+	header, err := peekProxyHeader(bufio.NewReader(bytes.NewBuffer(newProxyV2Header(unix, dst, nil))))
+	assert.NoError(t, err)
+	assert.Nil(t, header.sourceAddr)
+}
+
+func Test_ProxyProtocol(t *testing.T) {
+	remoteAddress := "127.0.0.1:11137"
+	lis, err := net.Listen("tcp", remoteAddress)
+	assert.NoError(t, err)
+	defer lis.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		data := make([]byte, 0)
+		buffer := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for !bytes.HasSuffix(data, []byte("ping")) {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				break
+			}
+			data = append(data, buffer[:n]...)
+		}
+		received <- string(data)
+	}()
+
+	groupConf := config.GetConfig().NewGroupConfig("11116")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.AcceptProxy = config.PROXYV2
+	groupConf.SendProxy = config.PROXYV1
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// the backend sees the client behind the load balancer, not the load balancer
+	clientConn, err := net.Dial("tcp", "localhost:11116")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+	_, err = clientConn.Write(append(newProxyV2Header(src, dst, nil), []byte("ping")...))
+	assert.NoError(t, err)
+	assert.Equal(t, "PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\nping", <-received)
+
+	// a client without the required header is dropped
+	clientConn, err = net.Dial("tcp", "localhost:11116")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	_, err = clientConn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\nping"))
+	assert.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_PeekProxyHeaderNone(t *testing.T) {
+	header, err := peekProxyHeader(bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n")))
+	assert.NoError(t, err)
+	assert.Nil(t, header)
+
+	// a short payload is not held up waiting for a full signature
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("666"))
+
+	header, err = peekProxyHeader(bufio.NewReader(server))
+	assert.NoError(t, err)
+	assert.Nil(t, header)
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"log"
+	"reflect"
+	"sync"
+
+	"github.com/wangff15386/goproxy/config"
+)
+
+// reloadLock serializes the reloads triggered by SIGHUP and the config file watcher
+var reloadLock sync.Mutex
+
+// Reload reads the config file again and applies it, a config that fails the validation is rejected
+// and the old config stays in force
+func Reload() error {
+	conf, err := config.Reload()
+	if err != nil {
+		log.Println("Rejected the config reload, error:", err)
+		return err
+	}
+
+	ApplyConfig(conf)
+	return nil
+}
+
+// ApplyConfig diffs the running groups against the config, only the changed groups are started,
+// stopped or reconfigured and the untouched groups keep their sessions. The acls of the configured
+// groups changed in the config are taken from it again, the ones set through the http api are dropped
+func ApplyConfig(conf config.ProxyConfig) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if err := SetAccessLog(conf.AccessLog); err != nil {
+		log.Println(err)
+	}
+
+	stateLock.Lock()
+	dropConfiguredACLs(conf)
+	desired := desiredGroups(conf, state)
+	stateLock.Unlock()
+
+	wanted := make(map[string]struct{})
+	for _, groupConf := range desired {
+		wanted[groupConf.Name] = struct{}{}
+	}
+
+	for _, group := range GetAllGroups() {
+		if _, ok := wanted[group]; !ok {
+			log.Println("Reload stops the removed group:", group)
+			if service, err := stopAccepting(group); err == nil {
+				go drain(group, service)
+			}
+		}
+	}
+
+	for _, groupConf := range desired {
+		service, err := getGroup(groupConf.Name)
+		if err != nil {
+			log.Println("Reload starts the new group:", groupConf.Name)
+			if err = StartService(groupConf); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		running := service.getConf()
+		switch {
+		case reflect.DeepEqual(running, groupConf):
+		case running.ListenAddress() != groupConf.ListenAddress() || running.Type != groupConf.Type:
+			// A new listen address can not be applied in place, the old listener is kept when the new one fails
+			log.Println("Reload restarts the group on a new listener:", groupConf.Name)
+			if err = restartService(groupConf); err != nil {
+				log.Println(err)
+			}
+		default:
+			service.reconfigure(groupConf)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+func Test_ApplyConfig(t *testing.T) {
+	remoteAddress := "127.0.0.1:11127"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	// The groups of the other tests are kept as they are
+	stateLock.Lock()
+	state = config.State{}
+	stateLock.Unlock()
+	conf := config.GetConfig()
+	others := make([]config.GroupConfig, 0)
+	for _, group := range GetAllGroups() {
+		groupConf, err := GetGroupConfig(group)
+		assert.NoError(t, err)
+		others = append(others, groupConf)
+	}
+
+	conf.Groups = append([]config.GroupConfig{
+		{Name: "reload-a", Listen: "11107", Servers: []string{remoteAddress}},
+		{Name: "reload-b", Listen: "11108", Servers: []string{remoteAddress}},
+	}, others...)
+	ApplyConfig(conf)
+	assert.Contains(t, GetAllGroups(), "reload-a")
+	assert.Contains(t, GetAllGroups(), "reload-b")
+
+	time.Sleep(200 * time.Millisecond)
+	clientConn, err := net.Dial("tcp", "localhost:11107")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	echoForTests(t, clientConn, "before reload")
+
+	// reload-a is reconfigured, reload-b is removed and reload-c is added
+	conf.Groups = append([]config.GroupConfig{
+		{Name: "reload-a", Listen: "11107", RWTimeout: 10 * time.Second, Servers: []string{remoteAddress}},
+		{Name: "reload-c", Listen: "11109", Servers: []string{remoteAddress}},
+	}, others...)
+	ApplyConfig(conf)
+	defer stopListenForTests("reload-a")
+	defer stopListenForTests("reload-c")
+
+	groupConf, err := GetGroupConfig("reload-a")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, groupConf.RWTimeout)
+	assert.NotContains(t, GetAllGroups(), "reload-b")
+	assert.Contains(t, GetAllGroups(), "reload-c")
+
+	// the session of the untouched listener survives the reload
+	echoForTests(t, clientConn, "after reload")
+	_, err = net.Dial("tcp", "localhost:11108")
+	assert.Error(t, err)
+
+	// stopListenForTests waits for the running session
+	clientConn.Close()
+}
+
+func Test_ApplyConfigRestart(t *testing.T) {
+	remoteAddress := "127.0.0.1:11172"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	stateLock.Lock()
+	state = config.State{}
+	stateLock.Unlock()
+	conf := config.GetConfig()
+	others := make([]config.GroupConfig, 0)
+	for _, group := range GetAllGroups() {
+		groupConf, err := GetGroupConfig(group)
+		assert.NoError(t, err)
+		others = append(others, groupConf)
+	}
+
+	pools := []config.PoolConfig{{Name: "blue"}}
+	conf.Groups = append([]config.GroupConfig{{Name: "reload-d", Listen: "11169", Servers: []string{remoteAddress}, Pools: pools}}, others...)
+	ApplyConfig(conf)
+	defer stopListenForTests("reload-d")
+	time.Sleep(200 * time.Millisecond)
+
+	worker, poolWorker := "127.0.0.1:11178", "127.0.0.1:11179"
+	assert.NoError(t, KeepAlive("reload-d", "", worker, 5))
+	assert.NoError(t, KeepAlive("reload-d", "blue", poolWorker, 0))
+
+	// the new listen address is taken, the group keeps its old listener
+	occupied, err := net.Listen("tcp", "127.0.0.1:11170")
+	assert.NoError(t, err)
+	defer occupied.Close()
+	conf.Groups[0].Listen = "11170"
+	ApplyConfig(conf)
+	groupConf, err := GetGroupConfig("reload-d")
+	assert.NoError(t, err)
+	assert.Equal(t, "11169", groupConf.Listen)
+	clientConn, err := net.Dial("tcp", "localhost:11169")
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "old listener")
+	clientConn.Close()
+
+	// the group moves once the new listener is bound
+	conf.Groups[0].Listen = "11171"
+	ApplyConfig(conf)
+	groupConf, err = GetGroupConfig("reload-d")
+	assert.NoError(t, err)
+	assert.Equal(t, "11171", groupConf.Listen)
+	time.Sleep(100 * time.Millisecond)
+	_, err = net.Dial("tcp", "localhost:11169")
+	assert.Error(t, err)
+	clientConn, err = net.Dial("tcp", "localhost:11171")
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "new listener")
+	clientConn.Close()
+
+	// the workers registered by heartbeats survive the restart
+	weights, err := GetAllWeights("reload-d")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{remoteAddress: 1, worker: 5}, weights)
+	servers, err := GetAllPools("reload-d")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"blue": {poolWorker}}, servers)
+}
+
+func echoForTests(t *testing.T, conn net.Conn, message string) {
+	data := []byte(message)
+	_, err := conn.Write(data)
+	assert.NoError(t, err)
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, message, string(buffer[:n]))
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"log"
+	"reflect"
+	"sync"
+
+	"github.com/wangff15386/goproxy/config"
+)
+
+// The changes made through the http api, they are persisted to the state file once it is restored
+var (
+	state     config.State
+	statePath string
+	stateLock sync.Mutex
+
+	loadedACLs map[string]config.ACLConfig // the acls of the groups in the last loaded config
+)
+
+// StartAllGroups restores the state file and starts the configured groups, the groups opened at runtime
+// and their workers, the changes made afterwards through the http api are persisted to the state file
+func StartAllGroups(conf config.ProxyConfig, path string) error {
+	if err := SetAccessLog(conf.AccessLog); err != nil {
+		return err
+	}
+
+	restored, err := config.LoadState(path)
+	if err != nil {
+		return err
+	}
+
+	stateLock.Lock()
+	state, statePath = restored, path
+	loadedACLs = configuredACLs(conf)
+	stateLock.Unlock()
+
+	for _, groupConf := range desiredGroups(conf, restored) {
+		if err := StartService(groupConf); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for _, remoteAddress := range restored.Workers[groupConf.Name] {
+			KeepAlive(groupConf.Name, "", remoteAddress, 0)
+		}
+		// The pools removed from the config meanwhile are skipped
+		for pool, workers := range restored.PoolWorkers[groupConf.Name] {
+			for _, remoteAddress := range workers {
+				KeepAlive(groupConf.Name, pool, remoteAddress, 0)
+			}
+		}
+	}
+	return nil
+}
+
+// desiredGroups returns the configured groups without the closed ones, plus the groups opened at runtime
+func desiredGroups(conf config.ProxyConfig, state config.State) []config.GroupConfig {
+	closed := make(map[string]struct{})
+	for _, name := range state.Closed {
+		closed[name] = struct{}{}
+	}
+
+	groups := make([]config.GroupConfig, 0)
+	configured := make(map[string]struct{})
+	for _, groupConf := range conf.GroupConfigs() {
+		configured[groupConf.Name] = struct{}{}
+		if _, ok := closed[groupConf.Name]; !ok {
+			groups = append(groups, withStateACL(groupConf, state))
+		}
+	}
+
+	for _, groupConf := range state.Opened {
+		if _, ok := configured[groupConf.Name]; !ok {
+			groups = append(groups, withStateACL(groupConf, state))
+		}
+	}
+	return groups
+}
+
+// withStateACL replaces the acl of the group by the one set through the http api
+func withStateACL(groupConf config.GroupConfig, state config.State) config.GroupConfig {
+	if acl, ok := state.ACLs[groupConf.Name]; ok {
+		groupConf.ACL = acl
+	}
+	return groupConf
+}
+
+// persistOpened records a group opened through the http api, only the settings of a group not configured are kept
+func persistOpened(groupConf config.GroupConfig, configured bool) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	state.Closed = removeName(state.Closed, groupConf.Name)
+	if !configured {
+		state.Opened = append(removeGroup(state.Opened, groupConf.Name), groupConf)
+	}
+	saveState()
+}
+
+// persistClosed records a group closed through the http api, its workers are forgotten
+func persistClosed(group string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	state.Opened = removeGroup(state.Opened, group)
+	if isConfiguredGroup(group) {
+		state.Closed = append(removeName(state.Closed, group), group)
+	}
+	delete(state.Workers, group)
+	delete(state.PoolWorkers, group)
+	saveState()
+}
+
+// persistWorkers records the registered workers of a group
+func persistWorkers(group string, workers []string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	if state.Workers == nil {
+		state.Workers = make(map[string][]string)
+	}
+	if len(workers) == 0 {
+		delete(state.Workers, group)
+	} else {
+		state.Workers[group] = workers
+	}
+	saveState()
+}
+
+// persistPoolWorkers records the registered workers of a named pool of a group
+func persistPoolWorkers(group, pool string, workers []string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	if len(workers) == 0 {
+		if pools, ok := state.PoolWorkers[group]; ok {
+			delete(pools, pool)
+			if len(pools) == 0 {
+				delete(state.PoolWorkers, group)
+			}
+		}
+	} else {
+		if state.PoolWorkers == nil {
+			state.PoolWorkers = make(map[string]map[string][]string)
+		}
+		if state.PoolWorkers[group] == nil {
+			state.PoolWorkers[group] = make(map[string][]string)
+		}
+		state.PoolWorkers[group][pool] = workers
+	}
+	saveState()
+}
+
+// dropConfiguredACLs forgets the acls set through the http api of the groups whose acl is changed in the
+// config, a reload leaving the acl of a group untouched keeps the one of the api. It must be called with the stateLock held
+func dropConfiguredACLs(conf config.ProxyConfig) {
+	loaded := loadedACLs
+	loadedACLs = configuredACLs(conf)
+
+	dropped := false
+	for _, groupConf := range conf.GroupConfigs() {
+		if reflect.DeepEqual(loaded[groupConf.Name], groupConf.ACL) {
+			continue
+		}
+		if _, ok := state.ACLs[groupConf.Name]; ok {
+			log.Printf("Reload replaces the acl set through the http api by the config, group: %s\n", groupConf.Name)
+			delete(state.ACLs, groupConf.Name)
+			dropped = true
+		}
+	}
+	if dropped {
+		saveState()
+	}
+}
+
+func configuredACLs(conf config.ProxyConfig) map[string]config.ACLConfig {
+	acls := make(map[string]config.ACLConfig)
+	for _, groupConf := range conf.GroupConfigs() {
+		acls[groupConf.Name] = groupConf.ACL
+	}
+	return acls
+}
+
+// persistACL records the acl of a group set through the http api, it is kept when the group is closed
+func persistACL(group string, acl config.ACLConfig) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	if state.ACLs == nil {
+		state.ACLs = make(map[string]config.ACLConfig)
+	}
+	state.ACLs[group] = acl
+	saveState()
+}
+
+// saveState writes the state file, it does nothing until the state is restored
+func saveState() {
+	if statePath == "" {
+		return
+	}
+
+	if err := config.SaveState(statePath, state); err != nil {
+		log.Println("Error to persist the state, error:", err)
+	}
+}
+
+func isConfiguredGroup(group string) bool {
+	_, ok := config.GetConfig().FindGroup(group)
+	return ok
+}
+
+func removeName(names []string, name string) []string {
+	result := make([]string, 0, len(names))
+	for _, n := range names {
+		if n != name {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+func removeGroup(groups []config.GroupConfig, name string) []config.GroupConfig {
+	result := make([]config.GroupConfig, 0, len(groups))
+	for _, groupConf := range groups {
+		if groupConf.Name != name {
+			result = append(result, groupConf)
+		}
+	}
+	return result
+}
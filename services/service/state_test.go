@@ -0,0 +1,57 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+func Test_StartAllGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, config.STATEFILENAME)
+	defer func() { statePath = "" }()
+
+	conf := config.GetConfig()
+	remoteAddress := "127.0.0.1:11126"
+	err = config.SaveState(path, config.State{
+		Opened:  []config.GroupConfig{conf.NewGroupConfig("11104")},
+		Closed:  []string{"8081"},
+		Workers: map[string][]string{"11104": {remoteAddress}},
+	})
+	assert.NoError(t, err)
+
+	// only the group opened at runtime is started, the configured ones are closed
+	assert.NoError(t, StartAllGroups(conf, path))
+	assert.Contains(t, GetAllGroups(), "11104")
+	assert.NotContains(t, GetAllGroups(), "8081")
+	addresses, err := GetAllAliveServerAddresses("11104")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{remoteAddress}, addresses)
+
+	assert.NoError(t, CloseGroup("11104"))
+	restored, err := config.LoadState(path)
+	assert.NoError(t, err)
+	assert.Empty(t, restored.Opened)
+	assert.Empty(t, restored.Workers)
+
+	assert.NoError(t, OpenGroup("11105"))
+	defer stopListenForTests("11105")
+	assert.NoError(t, KeepAlive("11105", "", remoteAddress, 0))
+	restored, err = config.LoadState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []config.GroupConfig{conf.NewGroupConfig("11105")}, restored.Opened)
+	assert.Equal(t, map[string][]string{"11105": {remoteAddress}}, restored.Workers)
+
+	// reopening a configured group removes it from the closed groups
+	assert.NoError(t, OpenGroup("8081"))
+	defer stopListenForTests("8081")
+	restored, err = config.LoadState(path)
+	assert.NoError(t, err)
+	assert.Empty(t, restored.Closed)
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wangff15386/goproxy/config"
+)
+
+// CERTCHECKINTERVAL how often the certificate files are checked for changes, at most once per handshake
+var CERTCHECKINTERVAL = time.Second
+
+// certReloader serves the certificate of a group and reloads it once its files change on disk,
+// a broken file keeps the certificate loaded before
+type certReloader struct {
+	certFile, keyFile string
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time // the later one of the two files
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load must be called with the lock held or before the reloader is shared
+func (reloader *certReloader) load() error {
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		return errors.WithMessage(err, "Error to load the certificate")
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return errors.WithMessage(err, "Error to load the certificate")
+	}
+
+	reloader.cert, reloader.modTime, reloader.checkedAt = &cert, modTime, time.Now()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return reloader.current(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (reloader *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return reloader.current(), nil
+}
+
+func (reloader *certReloader) current() *tls.Certificate {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	if time.Since(reloader.checkedAt) >= CERTCHECKINTERVAL {
+		reloader.checkedAt = time.Now()
+		if modTime, err := reloader.filesModTime(); err == nil && !modTime.Equal(reloader.modTime) {
+			if err = reloader.load(); err != nil {
+				log.Printf("%s, certfile: %s\n", err, reloader.certFile)
+			} else {
+				log.Println("Reloaded the certificate, certfile:", reloader.certFile)
+			}
+		}
+	}
+	return reloader.cert
+}
+
+// newServerTLSConfig builds the TLS settings of the listener of a group, nil when it terminates no TLS
+func newServerTLSConfig(conf config.TLSConfig) (*tls.Config, error) {
+	if !conf.Enabled() {
+		return nil, nil
+	}
+
+	version, err := conf.Version()
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := conf.Ciphers()
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := newCertReloader(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     version,
+		CipherSuites:   ciphers,
+	}
+
+	if conf.ClientCAFile != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(conf.ClientCAFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// newBackendTLSConfig builds the TLS settings of the dials to the backends of a group, nil when they are plaintext
+func newBackendTLSConfig(conf config.BackendTLSConfig) (*tls.Config, error) {
+	if !conf.Enabled() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	var err error
+	if conf.CAFile != "" {
+		if tlsConfig.RootCAs, err = loadCertPool(conf.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if conf.CertFile != "" {
+		reloader, err := newCertReloader(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM CA bundle
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Error to load the CA bundle")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("Error to load the CA bundle, no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// terminateTLS replaces the client connection of the session with the decrypted one once the handshake is done
+func (service *TCPProxySessionService) terminateTLS(clientProxySession *TCPProxySession, tlsConfig *tls.Config) error {
+	tlsConn := tls.Server(clientProxySession.Conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(clientProxySession.conf.RWTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("Error to handshake TLS, clientAddr: %s, error: %s", clientProxySession.clientAddr(), err)
+	}
+
+	// The periodical print and the drain read the client connection of the registered session
+	state := tlsConn.ConnectionState()
+	service.lock.Lock()
+	clientProxySession.Conn, clientProxySession.tlsState = tlsConn, &state
+	service.lock.Unlock()
+	return nil
+}
+
+// originateTLS returns the encrypted connection to the backend address once the handshake is done,
+// the host of the address is the server name when none is configured
+func originateTLS(serverConn net.Conn, address string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if tlsConfig.ServerName == "" {
+		if config.IsUnix(address) && !tlsConfig.InsecureSkipVerify {
+			return nil, fmt.Errorf("Error to handshake TLS with the remote address, a unix socket needs the servername")
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil && !config.IsUnix(address) {
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(serverConn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("Error to handshake TLS with the remote address, error: %s", err)
+	}
+	return tlsConn, nil
+}
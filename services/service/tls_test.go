@@ -0,0 +1,367 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+	"github.com/wangff15386/goproxy/services/metrics"
+)
+
+// certForTests a self-signed CA, or a certificate signed by one, generated at test time
+type certForTests struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+var serialForTests int64
+
+func newCertForTests(t *testing.T, dir, name string, ca *certForTests) *certForTests {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	serialForTests++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serialForTests),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	c := &certForTests{cert: cert, key: key, certFile: filepath.Join(dir, name+".pem"), keyFile: filepath.Join(dir, name+".key")}
+	assert.NoError(t, ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.NoError(t, ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return c
+}
+
+func (c *certForTests) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+func Test_TLSTermination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newCertForTests(t, dir, "ca", nil)
+	server := newCertForTests(t, dir, "server", ca)
+
+	remoteAddress := "127.0.0.1:11138"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11117")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.HashKey = config.HASHKEYSNI
+	groupConf.TLS = config.TLSConfig{CertFile: server.certFile, KeyFile: server.keyFile}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// the plaintext echo comes back through the terminated TLS
+	clientConn, err := tls.Dial("tcp", "localhost:11117", &tls.Config{RootCAs: ca.pool(), ServerName: "server"})
+	assert.NoError(t, err)
+	echoForTests(t, clientConn, "ping")
+	assert.Equal(t, server.cert.SerialNumber, clientConn.ConnectionState().PeerCertificates[0].SerialNumber)
+	clientConn.Close()
+
+	// the minimum version is TLS 1.2
+	_, err = tls.Dial("tcp", "localhost:11117", &tls.Config{RootCAs: ca.pool(), MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+
+	// a new certificate on disk is served without a restart
+	defer func(interval time.Duration) { CERTCHECKINTERVAL = interval }(CERTCHECKINTERVAL)
+	CERTCHECKINTERVAL = 0
+	time.Sleep(10 * time.Millisecond)
+	renewed := newCertForTests(t, dir, "server", ca)
+	clientConn, err = tls.Dial("tcp", "localhost:11117", &tls.Config{RootCAs: ca.pool(), ServerName: "server"})
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	echoForTests(t, clientConn, "pong")
+	assert.Equal(t, renewed.cert.SerialNumber, clientConn.ConnectionState().PeerCertificates[0].SerialNumber)
+}
+
+func Test_TLSClientAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newCertForTests(t, dir, "ca", nil)
+	server := newCertForTests(t, dir, "server", ca)
+	client := newCertForTests(t, dir, "client", ca)
+
+	remoteAddress := "127.0.0.1:11139"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11118")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.TLS = config.TLSConfig{CertFile: server.certFile, KeyFile: server.keyFile, MinVersion: "1.3", ClientCAFile: ca.certFile}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	// a client without a certificate is refused
+	clientConn, err := tls.Dial("tcp", "localhost:11118", &tls.Config{RootCAs: ca.pool(), ServerName: "server"})
+	if err == nil {
+		clientConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = clientConn.Read(make([]byte, 1))
+		clientConn.Close()
+	}
+	assert.Error(t, err)
+
+	cert, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+	assert.NoError(t, err)
+	clientConn, err = tls.Dial("tcp", "localhost:11118", &tls.Config{RootCAs: ca.pool(), ServerName: "server", Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	echoForTests(t, clientConn, "ping")
+	assert.Equal(t, uint16(tls.VersionTLS13), clientConn.ConnectionState().Version)
+
+	// a broken certificate file fails the start
+	groupConf = config.GetConfig().NewGroupConfig("11119")
+	groupConf.TLS = config.TLSConfig{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: server.keyFile}
+	assert.Error(t, StartService(groupConf))
+	assert.NotContains(t, GetAllGroups(), groupConf.Name)
+}
+
+func startTLSEchoRemoteForTests(t *testing.T, address string, tlsConfig *tls.Config) {
+	lis, err := tls.Listen("tcp", address, tlsConfig)
+	assert.NoError(t, err)
+
+	go func() {
+		defer lis.Close()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func Test_BackendTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newCertForTests(t, dir, "ca", nil)
+	server := newCertForTests(t, dir, "server", ca)
+	client := newCertForTests(t, dir, "client", ca)
+
+	// the remote requires a client certificate signed by the CA
+	serverCert, err := tls.LoadX509KeyPair(server.certFile, server.keyFile)
+	assert.NoError(t, err)
+	remoteAddress := "127.0.0.1:11140"
+	startTLSEchoRemoteForTests(t, remoteAddress, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	groupConf := config.GetConfig().NewGroupConfig("11141")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.BackendTLS = config.BackendTLSConfig{Enable: true, CAFile: ca.certFile, CertFile: client.certFile, KeyFile: client.keyFile, ServerName: "server"}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+
+	// a remote which can't be verified fails the dial
+	untrusted := config.GetConfig().NewGroupConfig("11142")
+	untrusted.Servers = []string{remoteAddress}
+	untrusted.BackendTLS = config.BackendTLSConfig{Enable: true, CertFile: client.certFile, KeyFile: client.keyFile}
+	assert.NoError(t, StartService(untrusted))
+	defer stopListenForTests(untrusted.Name)
+
+	// the lab setting accepts the certificate without the CA
+	insecure := config.GetConfig().NewGroupConfig("11143")
+	insecure.Servers = []string{remoteAddress}
+	insecure.BackendTLS = config.BackendTLSConfig{Enable: true, CertFile: client.certFile, KeyFile: client.keyFile, InsecureSkipVerify: true}
+	assert.NoError(t, StartService(insecure))
+	defer stopListenForTests(insecure.Name)
+	time.Sleep(200 * time.Millisecond)
+
+	for _, group := range []string{groupConf.Name, insecure.Name} {
+		clientConn, err := net.Dial("tcp", "localhost:"+group)
+		assert.NoError(t, err)
+		echoForTests(t, clientConn, "ping")
+		clientConn.Close()
+	}
+
+	dialErrors := metrics.DialErrors.Value(untrusted.Name, remoteAddress)
+	clientConn, err := net.Dial("tcp", "localhost:11142")
+	assert.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	clientConn.Close()
+	assert.Equal(t, dialErrors+1, metrics.DialErrors.Value(untrusted.Name, remoteAddress))
+
+	// the new settings apply to the new sessions
+	untrusted.BackendTLS.CAFile, untrusted.BackendTLS.ServerName = ca.certFile, "server"
+	service, err := getGroup(untrusted.Name)
+	assert.NoError(t, err)
+	service.reconfigure(untrusted)
+	clientConn, err = net.Dial("tcp", "localhost:11142")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	echoForTests(t, clientConn, "pong")
+}
+
+func Test_HealthCheckBackendTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newCertForTests(t, dir, "ca", nil)
+	server := newCertForTests(t, dir, "server", ca)
+	serverCert, err := tls.LoadX509KeyPair(server.certFile, server.keyFile)
+	assert.NoError(t, err)
+
+	// the remote expects the PROXY header of a health check before its TLS handshake
+	remoteAddress := "127.0.0.1:11167"
+	lis, err := net.Listen("tcp", remoteAddress)
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				header := make([]byte, len("PROXY UNKNOWN\r\n"))
+				if _, err := io.ReadFull(conn, header); err != nil || string(header) != "PROXY UNKNOWN\r\n" {
+					return
+				}
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+				io.Copy(tlsConn, tlsConn)
+			}()
+		}
+	}()
+
+	groupConf := config.GetConfig().NewGroupConfig("11168")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.SendProxy = config.PROXYV1
+	groupConf.BackendTLS = config.BackendTLSConfig{Enable: true, CAFile: ca.certFile, ServerName: "server"}
+	groupConf.HealthCheck = config.HealthCheckConfig{Type: config.HEALTHCHECKSEND, Interval: 50 * time.Millisecond,
+		Timeout: 500 * time.Millisecond, Rise: 1, Fall: 1, Send: "PING", Expect: "PING"}
+	assert.NoError(t, groupConf.Validate())
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+
+	// the probe speaks to the remote like the sessions do
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	assert.NoError(t, probeForTests(service, groupConf.HealthCheck, remoteAddress))
+	time.Sleep(300 * time.Millisecond)
+	health, err := GetAllHealth(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{remoteAddress: true}, health)
+
+	// a probe without the PROXY header gets no answer
+	groupConf.SendProxy = ""
+	service.reconfigure(groupConf)
+	assert.Error(t, probeForTests(service, groupConf.HealthCheck, remoteAddress))
+}
+
+// probeForTests runs the send probe of the health check through the dialer of the group
+func probeForTests(service *TCPProxySessionService, hc config.HealthCheckConfig, address string) error {
+	conn, err := service.dialProbe(address, hc.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(hc.Timeout))
+	if _, err = conn.Write([]byte(hc.Send)); err != nil {
+		return err
+	}
+	response := make([]byte, len(hc.Expect))
+	_, err = io.ReadFull(conn, response)
+	return err
+}
+
+func Test_TLSTerminationSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newCertForTests(t, dir, "ca", nil)
+	server := newCertForTests(t, dir, "server", ca)
+
+	remoteAddress := "127.0.0.1:11176"
+	go startEchoRemoteForTests(remoteAddress, make(chan struct{}, 10))
+
+	groupConf := config.GetConfig().NewGroupConfig("11177")
+	groupConf.Servers = []string{remoteAddress}
+	groupConf.TLS = config.TLSConfig{CertFile: server.certFile, KeyFile: server.keyFile}
+	assert.NoError(t, StartService(groupConf))
+	defer stopListenForTests(groupConf.Name)
+	time.Sleep(200 * time.Millisecond)
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+
+	// the sessions are read the way the periodical print does while their TLS is terminated
+	done := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			service.lock.RLock()
+			for _, clientProxySession := range service.proxySessions {
+				_ = clientProxySession.clientAddr().String()
+			}
+			service.lock.RUnlock()
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		clientConn, err := tls.Dial("tcp", "localhost:11177", &tls.Config{RootCAs: ca.pool(), ServerName: "server"})
+		assert.NoError(t, err)
+		echoForTests(t, clientConn, "ping")
+		clientConn.Close()
+	}
+	close(done)
+	<-read
+}
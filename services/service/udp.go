@@ -0,0 +1,255 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDPBUFFERSIZE the buffer of the udp groups holds the largest datagram, a smaller handlebuffer would truncate it
+const UDPBUFFERSIZE = 65535
+
+// UDPFLOWQUEUE datagrams of a flow waiting to be forwarded, the ones arriving on a full queue are dropped
+const UDPFLOWQUEUE = 64
+
+var errUDPListenerClosed = errors.New("use of closed udp listener")
+
+// udpListener turns the datagrams of every client address into a flow accepted like a tcp connection,
+// so the flows go through the same sessions as the tcp groups. The socket is kept open after Close
+// until the last flow is finished, the draining flows still get their datagrams
+type udpListener struct {
+	conn    net.PacketConn
+	accepts chan *udpFlow
+	closed  chan struct{}
+
+	lock    sync.Mutex
+	flows   map[string]*udpFlow
+	closing bool
+	filter  func(addr net.Addr) bool // reports whether a new client address may start a flow
+}
+
+func listenUDP(address string) (*udpListener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &udpListener{
+		conn:    conn,
+		accepts: make(chan *udpFlow),
+		closed:  make(chan struct{}),
+		flows:   make(map[string]*udpFlow),
+	}
+	go listener.dispatch()
+	return listener, nil
+}
+
+// dispatch reads the datagrams and hands them to their flows, a new client address starts a new flow
+func (listener *udpListener) dispatch() {
+	buffer := make([]byte, UDPBUFFERSIZE)
+	for {
+		n, addr, err := listener.conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			listener.closeFlows()
+			return
+		}
+
+		flow := listener.flow(addr)
+		if flow == nil {
+			continue
+		}
+
+		select {
+		case flow.datagrams <- append([]byte(nil), buffer[:n]...):
+		default:
+			log.Printf("Error to queue udp datagram, the flow is full, clientAddr: %s\n", addr)
+		}
+	}
+}
+
+// setFilter checks the new client addresses, the datagrams of a refused one are dropped
+func (listener *udpListener) setFilter(filter func(addr net.Addr) bool) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+
+	listener.filter = filter
+}
+
+// flow returns the flow of the client address, nil when it is new and the listener is closed or the filter refuses it
+func (listener *udpListener) flow(addr net.Addr) *udpFlow {
+	listener.lock.Lock()
+	flow, ok := listener.flows[addr.String()]
+	filter := listener.filter
+	if ok || listener.closing {
+		listener.lock.Unlock()
+		return flow
+	}
+	listener.lock.Unlock()
+
+	// Only dispatch creates the flows, the client address is still new after the filter
+	if filter != nil && !filter(addr) {
+		return nil
+	}
+
+	listener.lock.Lock()
+	if listener.closing {
+		listener.lock.Unlock()
+		return nil
+	}
+	flow = &udpFlow{listener: listener, addr: addr, datagrams: make(chan []byte, UDPFLOWQUEUE), done: make(chan struct{})}
+	listener.flows[addr.String()] = flow
+	listener.lock.Unlock()
+
+	select {
+	case listener.accepts <- flow:
+		return flow
+	case <-listener.closed:
+		listener.remove(flow)
+		return nil
+	}
+}
+
+func (listener *udpListener) remove(flow *udpFlow) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+
+	if current, ok := listener.flows[flow.addr.String()]; ok && current == flow {
+		delete(listener.flows, flow.addr.String())
+	}
+	if listener.closing && len(listener.flows) == 0 {
+		listener.conn.Close()
+	}
+}
+
+func (listener *udpListener) closeFlows() {
+	listener.lock.Lock()
+	flows := make([]*udpFlow, 0, len(listener.flows))
+	for _, flow := range listener.flows {
+		flows = append(flows, flow)
+	}
+	listener.lock.Unlock()
+
+	for _, flow := range flows {
+		flow.Close()
+	}
+}
+
+// Accept implements net.Listener
+func (listener *udpListener) Accept() (net.Conn, error) {
+	select {
+	case flow := <-listener.accepts:
+		return flow, nil
+	case <-listener.closed:
+		return nil, errUDPListenerClosed
+	}
+}
+
+// Close implements net.Listener, no new flow is accepted afterwards
+func (listener *udpListener) Close() error {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+
+	if listener.closing {
+		return errUDPListenerClosed
+	}
+	listener.closing = true
+	close(listener.closed)
+	if len(listener.flows) == 0 {
+		return listener.conn.Close()
+	}
+	return nil
+}
+
+// Addr implements net.Listener
+func (listener *udpListener) Addr() net.Addr {
+	return listener.conn.LocalAddr()
+}
+
+// udpFlow the datagrams of one client address, read as a connection until it is idle for rwtimeout
+type udpFlow struct {
+	listener  *udpListener
+	addr      net.Addr
+	datagrams chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+// Read returns one datagram, the rest of a datagram longer than b is dropped
+func (flow *udpFlow) Read(b []byte) (int, error) {
+	flow.lock.Lock()
+	deadline := flow.readDeadline
+	flow.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-flow.datagrams:
+		return copy(b, datagram), nil
+	case <-flow.done:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends b as one datagram to the client address
+func (flow *udpFlow) Write(b []byte) (int, error) {
+	select {
+	case <-flow.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return flow.listener.conn.WriteTo(b, flow.addr)
+}
+
+// Close finishes the flow, the next datagram of the client address starts a new one
+func (flow *udpFlow) Close() error {
+	flow.closeOnce.Do(func() {
+		close(flow.done)
+		flow.listener.remove(flow)
+	})
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (flow *udpFlow) LocalAddr() net.Addr {
+	return flow.listener.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn
+func (flow *udpFlow) RemoteAddr() net.Addr {
+	return flow.addr
+}
+
+// SetDeadline implements net.Conn
+func (flow *udpFlow) SetDeadline(t time.Time) error {
+	return flow.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (flow *udpFlow) SetReadDeadline(t time.Time) error {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+
+	flow.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn, a datagram is written at once
+func (flow *udpFlow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+// startUDPRemoteForTests answers every datagram with the name of the remote and the datagram
+func startUDPRemoteForTests(t *testing.T, address, name string) {
+	conn, err := net.ListenPacket("udp", address)
+	assert.NoError(t, err)
+
+	go func() {
+		defer conn.Close()
+		buffer := make([]byte, UDPBUFFERSIZE)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(name+":"), buffer[:n]...), addr)
+		}
+	}()
+}
+
+func exchangeForTests(t *testing.T, conn net.Conn, message string) string {
+	_, err := conn.Write([]byte(message))
+	assert.NoError(t, err)
+
+	buffer := make([]byte, UDPBUFFERSIZE)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	assert.NoError(t, err)
+	return string(buffer[:n])
+}
+
+func Test_UDPGroup(t *testing.T) {
+	startUDPRemoteForTests(t, "127.0.0.1:11148", "a")
+	startUDPRemoteForTests(t, "127.0.0.1:11149", "b")
+
+	groupConf := config.GetConfig().NewGroupConfig("11150")
+	groupConf.Name = "udp-test"
+	groupConf.Type = config.GROUPUDP
+	groupConf.LBPolicy = 2
+	groupConf.RWTimeout = 300 * time.Millisecond
+	groupConf.Servers = []string{"127.0.0.1:11148"}
+	assert.NoError(t, StartService(groupConf))
+
+	// the workers register like the ones of the tcp groups
+	assert.NoError(t, KeepAlive(groupConf.Name, "", "127.0.0.1:11149", 0))
+	list, err := GetAllAliveServerAddresses(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:11148", "127.0.0.1:11149"}, list)
+
+	// every client address is a flow which keeps its backend, a datagram bigger than handlebuffer is not truncated
+	first, err := net.Dial("udp", "localhost:11150")
+	assert.NoError(t, err)
+	defer first.Close()
+	second, err := net.Dial("udp", "localhost:11150")
+	assert.NoError(t, err)
+	defer second.Close()
+
+	backend := exchangeForTests(t, first, "ping")[:1]
+	other := map[string]string{"a": "b", "b": "a"}[backend]
+	assert.Equal(t, other+":ping", exchangeForTests(t, second, "ping"))
+	large := string(make([]byte, 4*groupConf.HandleBuffer))
+	assert.Equal(t, backend+":"+large, exchangeForTests(t, first, large))
+	assert.Equal(t, other+":pong", exchangeForTests(t, second, "pong"))
+
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, service.drainStatus().Sessions)
+	connections, err := GetAllConnections(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"127.0.0.1:11148": 1, "127.0.0.1:11149": 1}, connections)
+
+	// an idle flow expires, the next datagram starts a new flow
+	time.Sleep(3 * groupConf.RWTimeout)
+	assert.Equal(t, 0, service.drainStatus().Sessions)
+	assert.Contains(t, []string{"a:again", "b:again"}, exchangeForTests(t, first, "again"))
+	assert.Equal(t, 1, service.drainStatus().Sessions)
+	again := exchangeForTests(t, first, "again")[:1]
+
+	// a closing group keeps the socket for the running flows, the datagrams of new client addresses are dropped
+	stopped, err := stopAccepting(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, again[:1]+":still", exchangeForTests(t, first, "still"))
+	third, err := net.Dial("udp", "localhost:11150")
+	assert.NoError(t, err)
+	defer third.Close()
+	third.Write([]byte("late"))
+	third.SetReadDeadline(time.Now().Add(2 * groupConf.RWTimeout))
+	_, err = third.Read(make([]byte, 16))
+	assert.Error(t, err)
+
+	drain(groupConf.Name, stopped)
+	assert.Equal(t, 0, stopped.drainStatus().Sessions)
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// listenUnix listens on a unix domain socket, a socket file left by a crashed proxy is removed first.
+// The listener removes its socket file once it is closed
+func listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket removes the socket file nobody listens on, any other file is kept
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Error to listen unix socket, %s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("Error to listen unix socket, %s is in use", path)
+	}
+
+	log.Println("Removing stale unix socket:", path)
+	return os.Remove(path)
+}
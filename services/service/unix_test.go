@@ -0,0 +1,100 @@
+package service
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wangff15386/goproxy/config"
+)
+
+func startUnixEchoRemoteForTests(t *testing.T, path string) net.Listener {
+	lis, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis
+}
+
+func Test_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	remote := startUnixEchoRemoteForTests(t, filepath.Join(dir, "remote.sock"))
+	defer remote.Close()
+
+	// a socket file left by a crashed proxy
+	listenPath := filepath.Join(dir, "proxy.sock")
+	stale, err := net.Listen("unix", listenPath)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	groupConf := config.GetConfig().NewGroupConfig(config.UNIXPREFIX + listenPath)
+	groupConf.Servers = []string{config.UNIXPREFIX + filepath.Join(dir, "remote.sock")}
+	assert.NoError(t, StartService(groupConf))
+
+	// the clients of a unix socket have no address, each one is still a session of its own
+	first, err := net.Dial("unix", listenPath)
+	assert.NoError(t, err)
+	second, err := net.Dial("unix", listenPath)
+	assert.NoError(t, err)
+	echoForTests(t, first, "ping")
+	echoForTests(t, second, "pong")
+	service, err := getGroup(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, service.drainStatus().Sessions)
+	clients := service.onlineClients()
+	assert.Len(t, clients, 2)
+	assert.NotEqual(t, clients[0], clients[1])
+	for _, client := range clients {
+		assert.True(t, strings.HasPrefix(client, "unix:"), client)
+	}
+	first.Close()
+	second.Close()
+
+	// the workers register their sockets like the ports
+	worker := startUnixEchoRemoteForTests(t, filepath.Join(dir, "worker.sock"))
+	defer worker.Close()
+	assert.NoError(t, KeepAlive(groupConf.Name, "", config.UNIXPREFIX+filepath.Join(dir, "worker.sock"), 0))
+	list, err := GetAllAliveServerAddresses(groupConf.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{config.UNIXPREFIX + filepath.Join(dir, "remote.sock"), config.UNIXPREFIX + filepath.Join(dir, "worker.sock")}, list)
+
+	// a socket in use is not taken over
+	another := config.GetConfig().NewGroupConfig(config.UNIXPREFIX + listenPath)
+	another.Name = "unix-another"
+	assert.Error(t, StartService(another))
+
+	// the socket file is removed with the listener
+	assert.NoError(t, stopListenForTests(groupConf.Name))
+	time.Sleep(100 * time.Millisecond)
+	_, err = os.Stat(listenPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// a file which is not a socket is never removed
+	assert.NoError(t, ioutil.WriteFile(listenPath, []byte("data"), 0644))
+	assert.Error(t, StartService(groupConf))
+	data, err := ioutil.ReadFile(listenPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}